@@ -0,0 +1,57 @@
+package sidecar
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// AccessLog is a StatsHandler that logs each call when it ends.
+//
+// Entries record the method, the peer, the duration, the number and size of the
+// messages in each direction, and the grpc-status and grpc-message of the call.
+// Successful calls are logged at the Info level and failed calls at the Warn level.
+// To log the calls of a server, wrap its handler with HandleStats.
+type AccessLog struct {
+	logger *slog.Logger
+}
+
+// NewAccessLog creates an AccessLog that writes to a logger, or to slog.Default() if it is nil.
+func NewAccessLog(logger *slog.Logger) *AccessLog {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &AccessLog{logger: logger}
+}
+
+func (a *AccessLog) HandleStats(ctx context.Context, s *Stats) {
+	if s.Event != StatsEnd {
+		return
+	}
+	level, msg := slog.LevelInfo, "handled call"
+	if s.Client {
+		msg = "made call"
+	}
+	if s.Code != codes.OK {
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("method", s.Method),
+	}
+	if s.RemoteAddr != "" {
+		attrs = append(attrs, slog.String("peer", s.RemoteAddr))
+	}
+	attrs = append(attrs,
+		slog.Duration("duration", s.EndTime.Sub(s.BeginTime)),
+		slog.Int("messages_received", s.MessagesReceived),
+		slog.Int64("bytes_received", s.BytesReceived),
+		slog.Int("messages_sent", s.MessagesSent),
+		slog.Int64("bytes_sent", s.BytesSent),
+		slog.Int("grpc_status", int(s.Code)),
+	)
+	if s.Err != nil {
+		attrs = append(attrs, slog.String("grpc_message", s.Err.Error()))
+	}
+	a.logger.LogAttrs(ctx, level, msg, attrs...)
+}
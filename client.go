@@ -10,68 +10,114 @@ import (
 )
 
 // Client represents a gRPC client and includes an http.Client,
-// a host name, and a header to be sent with all requests.
+// a host name, a header to be sent with all requests,
+// the codec used to encode messages (protobuf if nil),
+// an optional service config with retry and hedging policies,
+// interceptors that are applied to all calls in order,
+// and the headers that calls forward from incoming requests
+// (DefaultPropagatedHeaders if nil, none if empty).
+// Calls are reported to any StatsHandler in the client options, and
+// headers from any Credentials are added to each call.
 type Client struct {
-	Host       string
-	Header     http.Header
-	HttpClient *http.Client
+	Host              string
+	Header            http.Header
+	HttpClient        *http.Client
+	Codec             Codec
+	ServiceConfig     *ServiceConfig
+	Interceptors      []ClientInterceptor
+	PropagatedHeaders []string
+	Credentials       PerRPCCredentials
 }
 
 type ClientOptions struct {
-	Address  string
-	Insecure bool
-	Headers  []string
+	Address           string
+	Insecure          bool
+	Headers           []string
+	Protocol          Protocol
+	Codec             Codec
+	ServiceConfig     *ServiceConfig
+	Interceptors      []ClientInterceptor
+	PropagatedHeaders []string
+	StatsHandler      StatsHandler
+	Credentials       PerRPCCredentials
+	// PingInterval is the time without any frames from a server after which the
+	// client pings it, and PingTimeout is the time after which the connection is
+	// closed if the ping is not answered. MaxConnectionIdle is the time after which
+	// connections without calls are closed. Zero values use the defaults of net/http.
+	PingInterval      time.Duration
+	PingTimeout       time.Duration
+	MaxConnectionIdle time.Duration
+	// InitialStreamWindowSize and InitialConnWindowSize are the HTTP/2 flow control
+	// windows for data received on each stream and on each connection, MaxFrameSize
+	// is the largest HTTP/2 frame that the client will read, and MaxHeaderListSize
+	// is the largest size of response headers that the client will read. Zero values
+	// use the defaults of net/http, and the limits of net/http apply. Clients follow
+	// the MaxConcurrentStreams limits of servers by opening more connections.
+	InitialStreamWindowSize int
+	InitialConnWindowSize   int
+	MaxFrameSize            int
+	MaxHeaderListSize       int
 }
 
 // NewClient creates a client representation from an address.
 // Addresses must be in the format "HOSTNAME:PORT" or "unix:@SOCKET".
 // Connections to port 443 use TLS. All others are cleartext (h2c).
 func NewClient(options ClientOptions) *Client {
-	// Expect TLS on port 443 and use the default HTTP client.
-	if strings.HasSuffix(options.Address, ":443") {
-		return (&Client{
-			Host:   "https://" + options.Address,
-			Header: defaultHeader(),
-			HttpClient: &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{InsecureSkipVerify: options.Insecure},
-				},
+	var host string
+	var transport *http.Transport
+	switch {
+	case strings.HasSuffix(options.Address, ":443"):
+		// Expect TLS on port 443.
+		host = "https://" + options.Address
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: options.Insecure},
+		}
+	case strings.HasPrefix(options.Address, "unix:"):
+		// Create a client that can call unix sockets.
+		host = strings.Replace(options.Address, "unix:", "http://", 1)
+		transport = &http.Transport{
+			Protocols: cleartextProtocols(options.Protocol),
+			DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+				addr = strings.TrimPrefix(addr, "http://")
+				addr = strings.TrimSuffix(addr, ":80")
+				addr = "@" + addr
+				return net.DialTimeout("unix", addr, 5*time.Second)
 			},
-		}).addHeaders(options.Headers)
+		}
+	default:
+		// Create a client for networked h2c connections.
+		host = "http://" + options.Address
+		transport = &http.Transport{
+			Protocols: cleartextProtocols(options.Protocol),
+		}
+	}
+	setHTTP2(transport, options)
+	client := &Client{
+		Host:              host,
+		Header:            defaultHeader(),
+		HttpClient:        &http.Client{Transport: transport},
+		Codec:             options.Codec,
+		ServiceConfig:     options.ServiceConfig,
+		Interceptors:      options.Interceptors,
+		PropagatedHeaders: options.PropagatedHeaders,
+		Credentials:       options.Credentials,
 	}
-	// All other clients need h2c-only support (HTTP/2 cleartext).
+	return client.addHeaders(options.Headers).setProtocol(options.Protocol).setStatsHandler(options.StatsHandler)
+}
+
+// cleartextProtocols returns the protocols of clients that don't use TLS,
+// which need h2c-only support (HTTP/2 cleartext).
+func cleartextProtocols(protocol Protocol) *http.Protocols {
 	protocols := new(http.Protocols)
 	protocols.SetUnencryptedHTTP2(true) // Enable h2c (HTTP/2 cleartext)
 	protocols.SetHTTP1(false)           // Explicitly disable HTTP/1.1
 	protocols.SetHTTP2(false)           // Explicitly disable encrypted HTTP/2 (HTTPS)
-	// If required, create a client that can call unix sockets.
-	if strings.HasPrefix(options.Address, "unix:") {
-		return (&Client{
-			Host:   strings.Replace(options.Address, "unix:", "http://", 1),
-			Header: defaultHeader(),
-			HttpClient: &http.Client{
-				Transport: &http.Transport{
-					Protocols: protocols,
-					DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
-						addr = strings.TrimPrefix(addr, "http://")
-						addr = strings.TrimSuffix(addr, ":80")
-						addr = "@" + addr
-						return net.DialTimeout("unix", addr, 5*time.Second)
-					},
-				},
-			},
-		}).addHeaders(options.Headers)
+	if protocol.isWeb() {
+		// gRPC-Web clients use HTTP/1.1, as browsers do.
+		protocols.SetUnencryptedHTTP2(false)
+		protocols.SetHTTP1(true)
 	}
-	// Create a client for networked h2c connections.
-	return (&Client{
-		Host:   "http://" + options.Address,
-		Header: defaultHeader(),
-		HttpClient: &http.Client{
-			Transport: &http.Transport{
-				Protocols: protocols,
-			},
-		},
-	}).addHeaders(options.Headers)
+	return protocols
 }
 
 func defaultHeader() http.Header {
@@ -91,3 +137,68 @@ func (client *Client) addHeaders(headers []string) *Client {
 	}
 	return client
 }
+
+// setHTTP2 applies the HTTP/2 and connection options to a transport.
+func setHTTP2(transport *http.Transport, options ClientOptions) {
+	transport.HTTP2 = &http.HTTP2Config{
+		MaxReadFrameSize:              options.MaxFrameSize,
+		MaxReceiveBufferPerConnection: options.InitialConnWindowSize,
+		MaxReceiveBufferPerStream:     options.InitialStreamWindowSize,
+		SendPingTimeout:               options.PingInterval,
+		PingTimeout:                   options.PingTimeout,
+	}
+	transport.MaxResponseHeaderBytes = int64(options.MaxHeaderListSize)
+	transport.IdleConnTimeout = options.MaxConnectionIdle
+}
+
+func (client *Client) setProtocol(protocol Protocol) *Client {
+	if protocol.isWeb() {
+		client.HttpClient.Transport = &webTransport{
+			base: client.HttpClient.Transport,
+			text: protocol == ProtocolGRPCWebText,
+		}
+	}
+	return client
+}
+
+func (client *Client) setStatsHandler(stats StatsHandler) *Client {
+	if stats != nil {
+		client.HttpClient.Transport = &statsTransport{
+			base:  client.HttpClient.Transport,
+			stats: stats,
+		}
+	}
+	return client
+}
+
+func (client *Client) propagatedHeaders() []string {
+	if client.PropagatedHeaders == nil {
+		return DefaultPropagatedHeaders
+	}
+	return client.PropagatedHeaders
+}
+
+// callHeader returns the header for an attempt of a call, which adds the
+// propagated headers of the incoming request and the client's credentials
+// to the header of the call.
+func (client *Client) callHeader(ctx context.Context, method string, header http.Header) (http.Header, error) {
+	result := header.Clone()
+	propagateHeaders(ctx, result, client.propagatedHeaders())
+	if client.Credentials != nil {
+		credentials, err := client.Credentials.Header(ctx, method)
+		if err != nil {
+			return nil, credentialsError(err)
+		}
+		for key, values := range credentials {
+			result[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	return result, nil
+}
+
+func (client *Client) codec() Codec {
+	if client.Codec == nil {
+		return ProtoCodec{}
+	}
+	return client.Codec
+}
@@ -0,0 +1,159 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// streamCall holds the state shared by client-streaming and bidi-streaming calls.
+//
+// Requests are written to a pipe that is the request body, and a goroutine
+// makes the HTTP request and waits for the response, setting resp and err
+// before closing done. Sends are serialized by sendMu and receives by recvMu,
+// so one goroutine can send while another receives.
+type streamCall struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	codec  Codec
+	writer *io.PipeWriter
+	pipe   *io.PipeReader
+	done   chan struct{}
+	resp   *http.Response
+	err    error
+	sendMu sync.Mutex
+	recvMu sync.Mutex
+}
+
+func startStreamCall(ctx context.Context, client *Client, method string, header http.Header) (*streamCall, error) {
+	url := client.Host + method
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, io.NopCloser(pr))
+	if err == nil {
+		req.Header, err = client.callHeader(ctx, method, header)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	call := &streamCall{
+		ctx:    ctx,
+		cancel: cancel,
+		codec:  client.codec(),
+		writer: pw,
+		pipe:   pr,
+		done:   make(chan struct{}),
+	}
+	req.Header.Set("Content-Type", contentTypeForCodec(call.codec))
+	go call.run(client.HttpClient, req)
+	return call, nil
+}
+
+func (c *streamCall) run(client *http.Client, req *http.Request) {
+	defer close(c.done)
+	resp, err := client.Do(req)
+	if err != nil {
+		c.err = transportError(c.ctx, err)
+		// Unblock senders, whose messages will never be read.
+		_ = c.pipe.CloseWithError(c.err)
+		return
+	}
+	c.resp = resp
+	c.err = errorForHeader(resp)
+	if c.err != nil {
+		_ = resp.Body.Close()
+		_ = c.pipe.CloseWithError(c.err)
+	}
+}
+
+// wait waits for the response to begin and returns any error that prevented it.
+func (c *streamCall) wait() error {
+	<-c.done
+	return c.err
+}
+
+func (c *streamCall) send(msg any) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return send(c.writer, msg, c.codec)
+}
+
+// closeSend ends the request stream. It does not wait for pending sends,
+// which fail if they have not completed.
+func (c *streamCall) closeSend() error {
+	return c.writer.Close()
+}
+
+func (c *streamCall) receive(msg any) error {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return receiveResponse(c.ctx, c.resp.Body, msg, c.codec)
+}
+
+// finish reads the rest of the response and returns its trailer and status.
+func (c *streamCall) finish() (http.Header, error) {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	defer c.cancel()
+	if err := c.wait(); err != nil {
+		return nil, err
+	}
+	if err := drainResponse(c.ctx, c.resp.Body); err != nil {
+		return nil, err
+	}
+	return c.resp.Trailer, ErrorForResponse(c.resp)
+}
+
+// abort resets the HTTP/2 stream of the call and fails any further sends.
+func (c *streamCall) abort() {
+	c.cancel()
+	_ = c.pipe.CloseWithError(NewError(context.Canceled, codes.Canceled))
+}
+
+// startIntercepted starts a client-streaming or bidi-streaming call through
+// the client's interceptors and returns the stream that they have wrapped.
+func startIntercepted[Res any](ctx context.Context, client *Client, method string, streamType StreamType) (*streamCall, MessageStream, error) {
+	var call *streamCall
+	start := chainClientStream(client.Interceptors, func(ctx context.Context, info *CallInfo) (MessageStream, error) {
+		var err error
+		call, err = startStreamCall(ctx, client, info.Method, info.Header)
+		if err != nil {
+			return nil, err
+		}
+		return &callMessages[Res]{call: call}, nil
+	})
+	messages, err := start(ctx, &CallInfo{Method: method, StreamType: streamType, Header: client.Header.Clone()})
+	if err != nil {
+		if call != nil {
+			call.abort()
+		}
+		return nil, nil, err
+	}
+	if call == nil {
+		return nil, nil, NewError(errors.New("interceptor did not start the call"), codes.Internal)
+	}
+	return call, messages, nil
+}
+
+// callMessages is the innermost stream of an intercepted streaming call.
+type callMessages[Res any] struct {
+	call *streamCall
+}
+
+func (m *callMessages[Res]) Send(msg any) error {
+	return m.call.send(msg)
+}
+
+func (m *callMessages[Res]) Receive() (any, error) {
+	var response Res
+	err := m.call.receive(&response)
+	return &response, err
+}
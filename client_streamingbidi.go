@@ -2,84 +2,112 @@ package sidecar
 
 import (
 	"context"
+	"errors"
 	"io"
+	"iter"
 	"net/http"
-	"sync"
-
-	"github.com/agentio/sidecar/codes"
 )
 
 // BidiStreamForClient holds state for a bidi-streaming RPC call.
+//
+// One goroutine may call Send and CloseSend (or CloseRequest) while another
+// calls Receive and CloseResponse. Cancel may be called from any goroutine.
+// Trailer is set by CloseResponse.
 type BidiStreamForClient[Req, Res any] struct {
 	Trailer http.Header
 
-	client *http.Client
-	req    *http.Request
-	resp   *http.Response
-	reader io.ReadCloser
-	writer io.WriteCloser
-	wg     sync.WaitGroup
-	code   codes.Code
+	call     *streamCall
+	messages MessageStream // set when interceptors are used
 }
 
 // CallBidiStream makes a bidi-streaming RPC call.
 //
 // The method argument should be the full path of the gRPC handler.
+// Calls pass through the client's interceptors.
 func CallBidiStream[Req, Res any](ctx context.Context, client *Client, method string) (*BidiStreamForClient[Req, Res], error) {
-	url := client.Host + method
-	pr, pw := io.Pipe()
-	stream := &BidiStreamForClient[Req, Res]{
-		writer: pw,
+	if len(client.Interceptors) > 0 {
+		call, messages, err := startIntercepted[Res](ctx, client, method, StreamTypeBidi)
+		if err != nil {
+			return nil, err
+		}
+		return &BidiStreamForClient[Req, Res]{call: call, messages: messages}, nil
 	}
-	stream.client = client.HttpClient
-	var err error
-	stream.req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, io.NopCloser(pr))
+	// The call completes its HTTP request when the server sends its first reply.
+	call, err := startStreamCall(ctx, client, method, client.Header)
 	if err != nil {
 		return nil, err
 	}
-	stream.req.Header = client.Header.Clone()
-	stream.wg.Go(func() {
-		// This will complete when the server sends its first reply.
-		resp, err := stream.client.Do(stream.req)
-		if err != nil {
-			return
-		}
-		stream.code = codes.CodeFromResponse(resp)
-		stream.reader = resp.Body
-		stream.resp = resp
-	})
-	return stream, err
+	return &BidiStreamForClient[Req, Res]{call: call}, nil
 }
 
 // Send sends a message to the bidi-streaming method.
 func (b *BidiStreamForClient[Req, Res]) Send(msg *Req) error {
-	return Send(b.writer, msg)
+	if b.messages != nil {
+		return b.messages.Send(msg)
+	}
+	return b.call.send(msg)
 }
 
-// CloseRequest closes the request-sending connection to the bidi-streaming method.
+// CloseRequest closes the request-sending connection to the bidi-streaming method
+// and waits for the response to begin.
 func (b *BidiStreamForClient[Req, Res]) CloseRequest() error {
-	err := b.writer.Close() // Close the writer when done streaming
-	b.wg.Wait()
+	err := b.call.closeSend()
+	_ = b.call.wait()
 	return err
 }
 
+// CloseSend closes the request-sending connection to the bidi-streaming method
+// without waiting for a response, so that the server receives the end of the stream.
+func (b *BidiStreamForClient[Req, Res]) CloseSend() error {
+	return b.call.closeSend()
+}
+
+// Cancel aborts the call by resetting its HTTP/2 stream with RST_STREAM(CANCEL),
+// which cancels the context of the server's handler. After Cancel, Send and
+// Receive return errors with the Canceled code.
+func (b *BidiStreamForClient[Req, Res]) Cancel() {
+	b.call.abort()
+}
+
 // Receive reads a message from the bidi-streaming method.
 func (b *BidiStreamForClient[Req, Res]) Receive() (*Res, error) {
-	b.wg.Wait() // wait for reader to be set
-	if b.code != codes.OK {
-		return nil, ErrorForCode(b.code)
+	if b.messages != nil {
+		return messageAs[Res](b.messages.Receive())
 	}
 	var response Res
-	err := Receive(b.reader, &response)
+	err := b.call.receive(&response)
 	return &response, err
 }
 
 // CloseResponse closes the connection to the bidi-streaming method.
 func (b *BidiStreamForClient[Req, Res]) CloseResponse() error {
-	_, err := io.ReadAll(b.reader)
-	if err != nil {
-		return err
+	trailer, err := b.call.finish()
+	b.Trailer = trailer
+	return err
+}
+
+// All returns an iterator over the messages from the bidi-streaming method.
+// When the stream ends, All calls CloseResponse and yields its error, if any.
+// Receive errors are yielded and end the iteration. If the iteration ends
+// early, All calls Cancel.
+func (b *BidiStreamForClient[Req, Res]) All() iter.Seq2[*Res, error] {
+	return func(yield func(*Res, error) bool) {
+		for {
+			response, err := b.Receive()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				b.Cancel()
+				yield(nil, err)
+				return
+			}
+			if !yield(response, nil) {
+				b.Cancel()
+				return
+			}
+		}
+		if err := b.CloseResponse(); err != nil {
+			yield(nil, err)
+		}
 	}
-	b.Trailer = b.resp.Trailer
-	return ErrorForTrailer(b.Trailer)
 }
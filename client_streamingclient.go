@@ -5,81 +5,67 @@ import (
 	"errors"
 	"io"
 	"net/http"
-	"sync"
-
-	"github.com/agentio/sidecar/codes"
 )
 
 // ClientStreamForClient holds state for a client-streaming RPC call.
+//
+// Send may be called from any goroutine. Trailer is set by CloseAndReceive.
 type ClientStreamForClient[Req, Res any] struct {
 	Trailer http.Header
 
-	client *http.Client
-	req    *http.Request
-	resp   *http.Response
-	reader io.ReadCloser
-	writer io.WriteCloser
-	wg     sync.WaitGroup
-	code   codes.Code
+	call     *streamCall
+	messages MessageStream // set when interceptors are used
 }
 
 // CallClientStream makes a client-streaming RPC call.
 //
 // The method argument should be the full path of the gRPC handler.
+// Calls pass through the client's interceptors.
 func CallClientStream[Req, Res any](ctx context.Context, client *Client, method string) (*ClientStreamForClient[Req, Res], error) {
-	url := client.Host + method
-	pr, pw := io.Pipe()
-	stream := &ClientStreamForClient[Req, Res]{
-		writer: pw,
+	if len(client.Interceptors) > 0 {
+		call, messages, err := startIntercepted[Res](ctx, client, method, StreamTypeClient)
+		if err != nil {
+			return nil, err
+		}
+		return &ClientStreamForClient[Req, Res]{call: call, messages: messages}, nil
 	}
-	stream.client = client.HttpClient
-	var err error
-	stream.req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, io.NopCloser(pr))
+	// The call completes its HTTP request when the client closes and the server reply is sent.
+	call, err := startStreamCall(ctx, client, method, client.Header)
 	if err != nil {
 		return nil, err
 	}
-	stream.req.Header = client.Header.Clone()
-	stream.wg.Go(func() {
-		// This will complete when the client closes and the server reply is sent.
-		resp, err := stream.client.Do(stream.req)
-		if err != nil {
-			return
-		}
-		stream.code = codes.CodeFromResponse(resp)
-		stream.reader = resp.Body
-		stream.resp = resp
-	})
-	return stream, err
+	return &ClientStreamForClient[Req, Res]{call: call}, nil
 }
 
 // Send sends a message to the client-streaming method.
 func (b *ClientStreamForClient[Req, Res]) Send(msg *Req) error {
-	err := Send(b.writer, msg)
-	if err != nil {
-		return err
+	if b.messages != nil {
+		return b.messages.Send(msg)
 	}
-	return err
+	return b.call.send(msg)
 }
 
 // CloseAndReceive closes the client connection and reads the response from the client-streaming method.
 func (b *ClientStreamForClient[Req, Res]) CloseAndReceive() (*Res, error) {
-	err := b.writer.Close()
+	err := b.call.closeSend()
 	if err != nil {
 		return nil, err
 	}
-	b.wg.Wait()
-	if b.code != codes.OK {
-		return nil, ErrorForCode(b.code)
+	var response *Res
+	if b.messages != nil {
+		response, err = messageAs[Res](b.messages.Receive())
+	} else {
+		response = new(Res)
+		err = b.call.receive(response)
 	}
-	var response Res
-	err = Receive(b.reader, &response)
 	if err != nil && !errors.Is(err, io.EOF) {
+		b.call.cancel()
 		return nil, err
 	}
-	_, err = io.ReadAll(b.reader)
+	trailer, err := b.call.finish()
+	b.Trailer = trailer
 	if err != nil {
 		return nil, err
 	}
-	b.Trailer = b.resp.Trailer
-	return &response, ErrorForTrailer(b.Trailer)
+	return response, nil
 }
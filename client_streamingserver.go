@@ -1,61 +1,221 @@
 package sidecar
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
+	"iter"
 	"net/http"
+	"sync"
 
 	"github.com/agentio/sidecar/codes"
 )
 
 // ServerStreamForClient holds state for a server-streaming RPC call.
+//
+// Receive and CloseResponse are serialized. Cancel may be called from any
+// goroutine. Trailer is set by CloseResponse.
 type ServerStreamForClient[Req, Res any] struct {
 	Trailer http.Header
 
+	ctx    context.Context
+	cancel context.CancelFunc
 	resp   *http.Response
 	reader io.ReadCloser
+	codec  Codec
+	mu     sync.Mutex
+
+	messages MessageStream // set when interceptors are used
 }
 
 // CallServerStream makes a server-streaming RPC call.
 //
 // The method argument should be the full path of the gRPC handler.
+// If the client's service config has a retry policy for the method, failed
+// calls are retried until the first response is received, so CallServerStream
+// waits for that response. Calls pass through the client's interceptors.
 func CallServerStream[Req, Res any](ctx context.Context, client *Client, method string, request *Request[Req]) (*ServerStreamForClient[Req, Res], error) {
-	buf, err := serialize(request.Msg)
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &ServerStreamForClient[Req, Res]{cancel: cancel}
+	if len(client.Interceptors) == 0 {
+		if err := stream.start(ctx, client, method, client.Header, request.Msg); err != nil {
+			cancel()
+			return nil, err
+		}
+		return stream, nil
+	}
+	start := chainClientStream(client.Interceptors, func(ctx context.Context, info *CallInfo) (MessageStream, error) {
+		return &serverStreamMessages[Req, Res]{ctx: ctx, client: client, info: info, stream: stream}, nil
+	})
+	messages, err := start(ctx, &CallInfo{Method: method, StreamType: StreamTypeServer, Header: client.Header.Clone()})
 	if err != nil {
+		stream.Cancel()
+		return nil, err
+	}
+	// The request is sent through the interceptors to start the call.
+	if err := messages.Send(request.Msg); err != nil {
+		stream.Cancel()
 		return nil, err
 	}
+	if stream.resp == nil {
+		stream.Cancel()
+		return nil, NewError(errors.New("interceptor did not start the call"), codes.Internal)
+	}
+	stream.messages = messages
+	return stream, nil
+}
+
+// start makes the HTTP request of a server-streaming call.
+func (b *ServerStreamForClient[Req, Res]) start(ctx context.Context, client *Client, method string, header http.Header, msg any) error {
+	codec := client.codec()
+	buf, err := serialize(msg, codec)
+	if err != nil {
+		return err
+	}
+	body := buf.Bytes()
+	config := client.ServiceConfig.methodConfig(method)
+	var resp *http.Response
+	if config == nil || config.RetryPolicy == nil {
+		resp, _, err = callServerStream(ctx, client, method, header, body, codec, false)
+	} else {
+		resp, err = retry(ctx, config.RetryPolicy, func(ctx context.Context) (*http.Response, http.Header, error) {
+			return callServerStream(ctx, client, method, header, body, codec, true)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	b.ctx = ctx
+	b.resp = resp
+	b.reader = resp.Body
+	b.codec = codec
+	return nil
+}
+
+// callServerStream makes one attempt of a server-streaming call.
+// If peek is true, it also waits for the first response message,
+// returning an error if the stream fails before sending one.
+func callServerStream(ctx context.Context, client *Client, method string, header http.Header, body []byte, codec Codec, peek bool) (*http.Response, http.Header, error) {
 	url := client.Host + method
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	req.Header, err = client.callHeader(ctx, method, header)
+	if err != nil {
+		return nil, nil, err
 	}
-	req.Header = client.Header.Clone()
+	req.Header.Set("Content-Type", contentTypeForCodec(codec))
 	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, transportError(ctx, err)
+	}
+	if err := errorForHeader(resp); err != nil {
+		_ = resp.Body.Close()
+		return nil, resp.Header, err
+	}
+	if !peek {
+		return resp, nil, nil
 	}
-	if code := codes.CodeFromResponse(resp); code != 0 {
-		return nil, ErrorForCode(codes.Code(code))
+	b, err := unframe(resp.Body)
+	if errors.Is(err, io.EOF) {
+		// The stream ended without any messages.
+		if err := ErrorForResponse(resp); err != nil {
+			_ = resp.Body.Close()
+			return nil, resp.Trailer, err
+		}
+		return resp, nil, nil
+	} else if err != nil {
+		_ = resp.Body.Close()
+		return nil, nil, responseError(ctx, err)
+	}
+	// Put the first message back in front of the rest of the stream.
+	resp.Body = &readCloser{Reader: io.MultiReader(frame(b), resp.Body), Closer: resp.Body}
+	return resp, nil, nil
+}
+
+// serverStreamMessages is the innermost stream of an intercepted server-streaming call.
+type serverStreamMessages[Req, Res any] struct {
+	ctx    context.Context
+	client *Client
+	info   *CallInfo
+	stream *ServerStreamForClient[Req, Res]
+}
+
+// Send starts the call with its request.
+func (m *serverStreamMessages[Req, Res]) Send(msg any) error {
+	if m.stream.resp != nil {
+		return NewError(errors.New("server-streaming calls send one request"), codes.Internal)
 	}
-	return &ServerStreamForClient[Req, Res]{
-		reader: resp.Body,
-		resp:   resp,
-	}, err
+	return m.stream.start(m.ctx, m.client, m.info.Method, m.info.Header, msg)
+}
+
+func (m *serverStreamMessages[Req, Res]) Receive() (any, error) {
+	return m.stream.receive()
 }
 
 // Receive reads a message from the server-streaming method.
 func (b *ServerStreamForClient[Req, Res]) Receive() (*Res, error) {
+	if b.messages != nil {
+		return messageAs[Res](b.messages.Receive())
+	}
+	return b.receive()
+}
+
+func (b *ServerStreamForClient[Req, Res]) receive() (*Res, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	var response Res
-	err := Receive(b.reader, &response)
+	err := receiveResponse(b.ctx, b.reader, &response, b.codec)
 	return &response, err
 }
 
 // CloseResponse closes the connection to the server-streaming method.
 func (b *ServerStreamForClient[Req, Res]) CloseResponse() error {
-	_, err := io.ReadAll(b.reader)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.cancel()
+	err := drainResponse(b.ctx, b.reader)
 	if err != nil {
 		return err
 	}
 	b.Trailer = b.resp.Trailer
-	return ErrorForTrailer(b.Trailer)
+	return ErrorForResponse(b.resp)
+}
+
+// Cancel aborts the call by closing its response, which resets its HTTP/2
+// stream and cancels the context of the server's handler. After Cancel,
+// Receive returns errors with the Canceled code.
+func (b *ServerStreamForClient[Req, Res]) Cancel() {
+	b.cancel()
+	if b.reader != nil {
+		_ = b.reader.Close()
+	}
+}
+
+// All returns an iterator over the messages from the server-streaming method.
+// When the stream ends, All calls CloseResponse and yields its error, if any.
+// Receive errors are yielded and end the iteration. If the iteration ends
+// early, All calls Cancel.
+func (b *ServerStreamForClient[Req, Res]) All() iter.Seq2[*Res, error] {
+	return func(yield func(*Res, error) bool) {
+		for {
+			response, err := b.Receive()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				b.Cancel()
+				yield(nil, err)
+				return
+			}
+			if !yield(response, nil) {
+				b.Cancel()
+				return
+			}
+		}
+		if err := b.CloseResponse(); err != nil {
+			yield(nil, err)
+		}
+	}
 }
@@ -1,48 +1,84 @@
 package sidecar
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"net/http"
-
-	"github.com/agentio/sidecar/codes"
 )
 
 // CallUnary makes a unary RPC call.
 //
 // The method argument should be the full path of the gRPC handler.
+// Failed calls are retried or hedged as specified by the client's service config,
+// and calls pass through the client's interceptors.
 func CallUnary[Req, Res any](ctx context.Context, client *Client, method string, request *Request[Req]) (*Response[Res], error) {
-	buf, err := serialize(request.Msg)
+	if len(client.Interceptors) == 0 {
+		return unary[Res](ctx, client, method, client.Header, request.Msg)
+	}
+	var trailer http.Header
+	fn := chainClientUnary(client.Interceptors, func(ctx context.Context, info *CallInfo, req any) (any, error) {
+		response, err := unary[Res](ctx, client, info.Method, info.Header, req)
+		if response == nil {
+			return nil, err
+		}
+		trailer = response.Trailer
+		return response.Msg, err
+	})
+	info := &CallInfo{Method: method, StreamType: StreamTypeUnary, Header: client.Header.Clone()}
+	msg, err := messageAs[Res](fn(ctx, info, request.Msg))
+	if msg == nil {
+		return nil, err
+	}
+	return &Response[Res]{Msg: msg, Trailer: trailer}, err
+}
+
+// unary makes a unary call with the retry and hedging policies of the client.
+func unary[Res any](ctx context.Context, client *Client, method string, header http.Header, msg any) (*Response[Res], error) {
+	codec := client.codec()
+	buf, err := serialize(msg, codec)
 	if err != nil {
 		return nil, err
 	}
+	body := buf.Bytes()
+	return invoke(ctx, client.ServiceConfig.methodConfig(method), func(ctx context.Context) (*Response[Res], http.Header, error) {
+		return callUnary[Res](ctx, client, method, header, body, codec)
+	})
+}
+
+// callUnary makes one attempt of a unary call.
+func callUnary[Res any](ctx context.Context, client *Client, method string, header http.Header, body []byte, codec Codec) (*Response[Res], http.Header, error) {
 	url := client.Host + method
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	req.Header, err = client.callHeader(ctx, method, header)
+	if err != nil {
+		return nil, nil, err
 	}
-	req.Header = client.Header.Clone()
-	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Content-Type", contentTypeForCodec(codec))
 	resp, err := client.HttpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, transportError(ctx, err)
 	}
-	if code := codes.CodeFromResponse(resp); code != 0 {
-		return nil, ErrorForCode(codes.Code(code))
+	if err := errorForHeader(resp); err != nil {
+		_ = resp.Body.Close()
+		return nil, resp.Header, err
 	}
 	defer func() { _ = resp.Body.Close() }()
 	var response Res
-	err = Receive(resp.Body, &response)
+	err = receiveResponse(ctx, resp.Body, &response, codec)
 	if err != nil && !errors.Is(err, io.EOF) {
-		return nil, err
+		return nil, nil, err
 	}
-	_, err = io.ReadAll(resp.Body)
+	err = drainResponse(ctx, resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	return &Response[Res]{
 		Msg:     &response,
 		Trailer: resp.Trailer,
-	}, ErrorForTrailer(resp.Trailer)
+	}, resp.Trailer, ErrorForTrailer(resp.Trailer)
 }
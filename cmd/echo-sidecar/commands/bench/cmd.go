@@ -0,0 +1,208 @@
+// Package bench implements load tests of the Echo service.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agentio/sidecar"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/constants"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/genproto/echopb"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/track"
+	"github.com/spf13/cobra"
+)
+
+// rateInterval returns the time between calls made at a rate, or zero for an unlimited rate.
+func rateInterval(rate float64) (time.Duration, error) {
+	if rate == 0 {
+		return 0, nil
+	}
+	interval := float64(time.Second) / rate
+	if !(rate > 0) || interval < 1 || interval > math.MaxInt64 {
+		return 0, fmt.Errorf("rate must be positive and give an interval between 1ns and %s, got %g", time.Duration(math.MaxInt64), rate)
+	}
+	return time.Duration(interval), nil
+}
+
+// A caller makes a single call of a benchmarked method.
+type caller func(ctx context.Context, client *sidecar.Client) error
+
+func Cmd() *cobra.Command {
+	var message string
+	var address string
+	var n int
+	var duration time.Duration
+	var concurrency int
+	var connections int
+	var rate float64
+	var messages int
+	var jsonOutput bool
+	var insecure bool
+	var headers []string
+	cmd := &cobra.Command{
+		Use:       "bench METHOD",
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"get", "expand", "collect", "update"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			call, err := callerForMethod(args[0], message, messages)
+			if err != nil {
+				return err
+			}
+			if concurrency < 1 || connections < 1 {
+				return errors.New("concurrency and connections must be at least 1")
+			}
+			interval, err := rateInterval(rate)
+			if err != nil {
+				return err
+			}
+			// Each client has its own transport and therefore its own connection.
+			clients := make([]*sidecar.Client, connections)
+			for i := range clients {
+				clients[i] = sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers})
+			}
+			var tokens <-chan time.Time
+			if interval > 0 {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				tokens = ticker.C
+			}
+			var deadline time.Time
+			if duration > 0 {
+				deadline = time.Now().Add(duration)
+			}
+			recorder := track.NewRecorder()
+			var started atomic.Int64
+			var wg sync.WaitGroup
+			start := time.Now()
+			for i := range concurrency {
+				client := clients[i%len(clients)]
+				wg.Go(func() {
+					for {
+						if duration > 0 {
+							if time.Now().After(deadline) {
+								return
+							}
+						} else if started.Add(1) > int64(n) {
+							return
+						}
+						if tokens != nil {
+							select {
+							case <-tokens:
+							case <-cmd.Context().Done():
+								return
+							}
+						}
+						t := time.Now()
+						err := call(cmd.Context(), client)
+						recorder.Record(time.Since(t), err)
+					}
+				})
+			}
+			wg.Wait()
+			summary := recorder.Summary(args[0], time.Since(start))
+			if jsonOutput {
+				return summary.WriteJSON(cmd.OutOrStdout())
+			}
+			summary.WriteText(cmd.OutOrStdout())
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&message, "message", "m", "hello", "message to send")
+	cmd.Flags().StringVarP(&address, "address", "a", "unix:@echo", "address of the echo server to use")
+	cmd.Flags().IntVarP(&n, "number", "n", 1000, "total number of calls to make (ignored if --duration is set)")
+	cmd.Flags().DurationVarP(&duration, "duration", "d", 0, "duration of the test")
+	cmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "number of concurrent callers")
+	cmd.Flags().IntVar(&connections, "connections", 1, "number of connections shared by the callers")
+	cmd.Flags().Float64VarP(&rate, "rate", "r", 0, "maximum calls per second (0 for unlimited)")
+	cmd.Flags().IntVar(&messages, "messages", 3, "number of messages to send in each client or bidi stream")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "write the summary as JSON")
+	cmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "disable TLS certificate verification")
+	cmd.Flags().StringArrayVarP(&headers, "header", "H", []string{}, "headers to add to the request")
+	return cmd
+}
+
+func callerForMethod(method, message string, messages int) (caller, error) {
+	switch method {
+	case "get":
+		return func(ctx context.Context, client *sidecar.Client) error {
+			_, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](
+				ctx,
+				client,
+				constants.EchoGetProcedure,
+				sidecar.NewRequest(&echopb.EchoRequest{Text: message}),
+			)
+			return err
+		}, nil
+	case "expand":
+		return func(ctx context.Context, client *sidecar.Client) error {
+			stream, err := sidecar.CallServerStream[echopb.EchoRequest, echopb.EchoResponse](
+				ctx,
+				client,
+				constants.EchoExpandProcedure,
+				sidecar.NewRequest(&echopb.EchoRequest{Text: message}),
+			)
+			if err != nil {
+				return err
+			}
+			for _, err := range stream.All() {
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	case "collect":
+		return func(ctx context.Context, client *sidecar.Client) error {
+			stream, err := sidecar.CallClientStream[echopb.EchoRequest, echopb.EchoResponse](
+				ctx,
+				client,
+				constants.EchoCollectProcedure,
+			)
+			if err != nil {
+				return err
+			}
+			for range messages {
+				if err := stream.Send(&echopb.EchoRequest{Text: message}); err != nil {
+					return err
+				}
+			}
+			_, err = stream.CloseAndReceive()
+			return err
+		}, nil
+	case "update":
+		return func(ctx context.Context, client *sidecar.Client) error {
+			stream, err := sidecar.CallBidiStream[echopb.EchoRequest, echopb.EchoResponse](
+				ctx,
+				client,
+				constants.EchoUpdateProcedure,
+			)
+			if err != nil {
+				return err
+			}
+			for range messages {
+				if err := stream.Send(&echopb.EchoRequest{Text: message}); err != nil {
+					return err
+				}
+				if _, err := stream.Receive(); err != nil {
+					return err
+				}
+			}
+			if err := stream.CloseRequest(); err != nil {
+				return err
+			}
+			for _, err := range stream.All() {
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown method %q, expected one of get, expand, collect, update", method)
+	}
+}
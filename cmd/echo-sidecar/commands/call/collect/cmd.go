@@ -8,6 +8,8 @@ import (
 	"github.com/agentio/sidecar"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/constants"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/genproto/echopb"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/input"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/recording"
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/encoding/protojson"
 )
@@ -19,11 +21,23 @@ func Cmd() *cobra.Command {
 	var verbose bool
 	var insecure bool
 	var headers []string
+	var record string
+	var protocol string
+	var codecName string
+	var inputName string
 	cmd := &cobra.Command{
 		Use:  "collect",
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			client := sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers})
+			codec, ok := sidecar.CodecForName(codecName)
+			if !ok {
+				return fmt.Errorf("unknown codec %q", codecName)
+			}
+			client, closeRecording, err := recording.Wrap(sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers, Protocol: sidecar.Protocol(protocol), Codec: codec}), record)
+			if err != nil {
+				return err
+			}
+			defer closeRecording()
 			stream, err := sidecar.CallClientStream[echopb.EchoRequest, echopb.EchoResponse](
 				cmd.Context(),
 				client,
@@ -32,12 +46,28 @@ func Cmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			for range 3 {
-				err = stream.Send(&echopb.EchoRequest{Text: message})
+			send := func(request *echopb.EchoRequest) error {
+				err := stream.Send(request)
 				if err != nil {
 					log.Printf("Error writing to pipe: %v", err)
+				}
+				return err
+			}
+			if inputName != "" {
+				in, err := input.Open(cmd, inputName)
+				if err != nil {
 					return err
 				}
+				defer func() { _ = in.Close() }()
+				if err = input.ForEach(in, send); err != nil {
+					return err
+				}
+			} else {
+				for range n {
+					if err = send(&echopb.EchoRequest{Text: message}); err != nil {
+						return err
+					}
+				}
 			}
 			response, err := stream.CloseAndReceive()
 			if err != nil {
@@ -60,9 +90,13 @@ func Cmd() *cobra.Command {
 	}
 	cmd.Flags().StringVarP(&message, "message", "m", "hello", "message")
 	cmd.Flags().StringVarP(&address, "address", "a", "unix:@echo", "address of the echo server to use")
-	cmd.Flags().IntVarP(&n, "number", "n", 1, "number of times to call the method")
+	cmd.Flags().IntVarP(&n, "number", "n", 3, "number of times to send the message")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
 	cmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "disable TLS certificate verification")
 	cmd.Flags().StringArrayVarP(&headers, "header", "H", []string{}, "headers to add to the request")
+	cmd.Flags().StringVar(&protocol, "protocol", "grpc", "protocol to use (grpc, grpc-web, or grpc-web-text)")
+	cmd.Flags().StringVar(&codecName, "codec", "proto", "codec used to encode messages (proto or json)")
+	cmd.Flags().StringVar(&record, "record", "", "append a JSONL recording of the call to this file")
+	cmd.Flags().StringVarP(&inputName, "input", "f", "", "file of newline-delimited JSON requests to send (\"-\" for stdin)")
 	return cmd
 }
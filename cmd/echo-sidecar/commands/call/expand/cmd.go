@@ -2,13 +2,13 @@
 package expand
 
 import (
-	"errors"
 	"fmt"
-	"io"
+	"os"
 
 	"github.com/agentio/sidecar"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/constants"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/genproto/echopb"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/recording"
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/encoding/protojson"
 )
@@ -20,11 +20,33 @@ func Cmd() *cobra.Command {
 	var verbose bool
 	var insecure bool
 	var headers []string
+	var record string
+	var protocol string
+	var codecName string
+	var serviceConfig string
 	cmd := &cobra.Command{
 		Use:  "expand",
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			client := sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers})
+			codec, ok := sidecar.CodecForName(codecName)
+			if !ok {
+				return fmt.Errorf("unknown codec %q", codecName)
+			}
+			var config *sidecar.ServiceConfig
+			if serviceConfig != "" {
+				b, err := os.ReadFile(serviceConfig)
+				if err != nil {
+					return err
+				}
+				if config, err = sidecar.ParseServiceConfig(b); err != nil {
+					return err
+				}
+			}
+			client, closeRecording, err := recording.Wrap(sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers, Protocol: sidecar.Protocol(protocol), Codec: codec, ServiceConfig: config}), record)
+			if err != nil {
+				return err
+			}
+			defer closeRecording()
 
 			stream, err := sidecar.CallServerStream[echopb.EchoRequest, echopb.EchoResponse](
 				cmd.Context(),
@@ -35,11 +57,8 @@ func Cmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			for {
-				response, err := stream.Receive()
-				if errors.Is(err, io.EOF) {
-					break
-				} else if err != nil {
+			for response, err := range stream.All() {
+				if err != nil {
 					return err
 				}
 				body, err := protojson.Marshal(response)
@@ -49,10 +68,6 @@ func Cmd() *cobra.Command {
 				_, _ = cmd.OutOrStdout().Write(body)
 				_, _ = cmd.OutOrStdout().Write([]byte("\n"))
 			}
-			err = stream.CloseResponse()
-			if err != nil {
-				return err
-			}
 			if verbose {
 				fmt.Println("Response Trailers:")
 				for key, values := range stream.Trailer {
@@ -68,5 +83,9 @@ func Cmd() *cobra.Command {
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
 	cmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "disable TLS certificate verification")
 	cmd.Flags().StringArrayVarP(&headers, "header", "H", []string{}, "headers to add to the request")
+	cmd.Flags().StringVar(&protocol, "protocol", "grpc", "protocol to use (grpc, grpc-web, or grpc-web-text)")
+	cmd.Flags().StringVar(&codecName, "codec", "proto", "codec used to encode messages (proto or json)")
+	cmd.Flags().StringVar(&record, "record", "", "append a JSONL recording of the call to this file")
+	cmd.Flags().StringVar(&serviceConfig, "service-config", "", "gRPC service config JSON file with retry or hedging policies")
 	return cmd
 }
@@ -4,11 +4,13 @@ package get
 import (
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/agentio/sidecar"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/constants"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/genproto/echopb"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/recording"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/track"
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -21,11 +23,33 @@ func Cmd() *cobra.Command {
 	var verbose bool
 	var insecure bool
 	var headers []string
+	var record string
+	var protocol string
+	var codecName string
+	var serviceConfig string
 	cmd := &cobra.Command{
 		Use:  "get",
 		Args: cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			client := sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers})
+			codec, ok := sidecar.CodecForName(codecName)
+			if !ok {
+				return fmt.Errorf("unknown codec %q", codecName)
+			}
+			var config *sidecar.ServiceConfig
+			if serviceConfig != "" {
+				b, err := os.ReadFile(serviceConfig)
+				if err != nil {
+					return err
+				}
+				if config, err = sidecar.ParseServiceConfig(b); err != nil {
+					return err
+				}
+			}
+			client, closeRecording, err := recording.Wrap(sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure, Headers: headers, Protocol: sidecar.Protocol(protocol), Codec: codec, ServiceConfig: config}), record)
+			if err != nil {
+				return err
+			}
+			defer closeRecording()
 			defer track.Measure(time.Now(), "get", n, cmd.OutOrStdout())
 			for j := 0; j < n; j++ {
 				response, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](
@@ -64,5 +88,9 @@ func Cmd() *cobra.Command {
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
 	cmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "disable TLS certificate verification")
 	cmd.Flags().StringArrayVarP(&headers, "header", "H", []string{}, "headers to add to the request")
+	cmd.Flags().StringVar(&protocol, "protocol", "grpc", "protocol to use (grpc, grpc-web, or grpc-web-text)")
+	cmd.Flags().StringVar(&codecName, "codec", "proto", "codec used to encode messages (proto or json)")
+	cmd.Flags().StringVar(&record, "record", "", "append a JSONL recording of the call to this file")
+	cmd.Flags().StringVar(&serviceConfig, "service-config", "", "gRPC service config JSON file with retry or hedging policies")
 	return cmd
 }
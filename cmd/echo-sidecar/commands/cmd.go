@@ -2,7 +2,10 @@
 package commands
 
 import (
+	"github.com/agentio/sidecar/cmd/echo-sidecar/commands/bench"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/commands/call"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/commands/mock"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/commands/replay"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/commands/serve"
 	"github.com/spf13/cobra"
 )
@@ -12,7 +15,10 @@ func Cmd() *cobra.Command {
 		Use: "echo-sidecar",
 	}
 
+	cmd.AddCommand(bench.Cmd())
 	cmd.AddCommand(call.Cmd())
+	cmd.AddCommand(mock.Cmd())
+	cmd.AddCommand(replay.Cmd())
 	cmd.AddCommand(serve.Cmd())
 	return cmd
 }
@@ -0,0 +1,203 @@
+// Package mock implements a mock server that answers from scripted responses.
+package mock
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/agentio/sidecar"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func Cmd() *cobra.Command {
+	var port int
+	var socket string
+	var descriptor string
+	var scriptName string
+	var verbose bool
+	cmd := &cobra.Command{
+		Use:  "mock",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			services, err := readDescriptorSet(descriptor)
+			if err != nil {
+				return err
+			}
+			script := &Script{}
+			if scriptName != "" {
+				script, err = readScript(scriptName)
+				if err != nil {
+					return err
+				}
+			}
+			mux := http.NewServeMux()
+			paths := make(map[string]bool)
+			for _, service := range services {
+				methods := service.Methods()
+				for i := range methods.Len() {
+					desc := methods.Get(i)
+					path := fmt.Sprintf("/%s/%s", service.FullName(), desc.Name())
+					m, err := compile(desc, script.Methods[path])
+					if err != nil {
+						return fmt.Errorf("%s: %w", path, err)
+					}
+					mux.HandleFunc(path, m.handler())
+					paths[path] = true
+					if verbose {
+						log.Printf("mocking %s", path)
+					}
+				}
+			}
+			for name := range script.Methods {
+				if !paths[methodPath(name)] {
+					return fmt.Errorf("script includes %s, which is not in %s", name, descriptor)
+				}
+			}
+			server := sidecar.NewServer(mux)
+			var listener net.Listener
+			if port == 0 {
+				listener, err = net.Listen("unix", socket)
+			} else {
+				listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+			}
+			if err != nil {
+				return err
+			}
+			return server.Serve(listener)
+		},
+	}
+	cmd.Flags().IntVarP(&port, "port", "p", 0, "server port")
+	cmd.Flags().StringVarP(&socket, "socket", "s", "@echo", "server socket")
+	cmd.Flags().StringVarP(&descriptor, "descriptor", "d", "", "file descriptor set describing the mocked services")
+	cmd.Flags().StringVar(&scriptName, "script", "", "YAML file of scripted responses")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
+	_ = cmd.MarkFlagRequired("descriptor")
+	return cmd
+}
+
+// readDescriptorSet reads the services in a file descriptor set,
+// such as one written by "protoc --include_imports --descriptor_set_out".
+func readDescriptorSet(name string) ([]protoreflect.ServiceDescriptor, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	var services []protoreflect.ServiceDescriptor
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		for i := range file.Services().Len() {
+			services = append(services, file.Services().Get(i))
+		}
+		return true
+	})
+	return services, nil
+}
+
+func (m *method) handler() func(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case m.desc.IsStreamingClient() && m.desc.IsStreamingServer():
+		return sidecar.HandleBidiStreaming(m.bidi)
+	case m.desc.IsStreamingClient():
+		return sidecar.HandleClientStreaming(m.clientStreaming)
+	case m.desc.IsStreamingServer():
+		return sidecar.HandleServerStreaming(m.serverStreaming)
+	default:
+		return sidecar.HandleUnary(m.unary)
+	}
+}
+
+// respond returns the first scripted response or the scripted error.
+func (m *method) respond(ctx context.Context) (*sidecar.Response[[]byte], error) {
+	if err := sleep(ctx, m.delay); err != nil {
+		return nil, err
+	}
+	if len(m.responses) > 0 {
+		if err := sleep(ctx, m.responses[0].delay); err != nil {
+			return nil, err
+		}
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	body := m.first()
+	return sidecar.NewResponse(&body), nil
+}
+
+func (m *method) unary(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+	if err := m.validate(*req.Msg); err != nil {
+		return nil, err
+	}
+	return m.respond(ctx)
+}
+
+func (m *method) serverStreaming(ctx context.Context, req *sidecar.Request[[]byte], stream *sidecar.ServerStream[[]byte]) error {
+	if err := m.validate(*req.Msg); err != nil {
+		return err
+	}
+	if err := sleep(ctx, m.delay); err != nil {
+		return err
+	}
+	for _, r := range m.responses {
+		if err := sleep(ctx, r.delay); err != nil {
+			return err
+		}
+		if err := stream.Send(&r.body); err != nil {
+			return err
+		}
+	}
+	return m.err
+}
+
+func (m *method) clientStreaming(ctx context.Context, stream *sidecar.ClientStream[[]byte]) (*sidecar.Response[[]byte], error) {
+	for request, err := range stream.All() {
+		if err != nil {
+			return nil, err
+		}
+		if err := m.validate(*request); err != nil {
+			return nil, err
+		}
+	}
+	return m.respond(ctx)
+}
+
+func (m *method) bidi(ctx context.Context, stream *sidecar.BidiStream[[]byte, []byte]) error {
+	if err := sleep(ctx, m.delay); err != nil {
+		return err
+	}
+	i := 0
+	for request, err := range stream.All() {
+		if err != nil {
+			return err
+		}
+		if err := m.validate(*request); err != nil {
+			return err
+		}
+		if len(m.responses) == 0 {
+			continue
+		}
+		r := m.responses[i%len(m.responses)]
+		i++
+		if err := sleep(ctx, r.delay); err != nil {
+			return err
+		}
+		if err := stream.Send(&r.body); err != nil {
+			return err
+		}
+	}
+	return m.err
+}
@@ -0,0 +1,153 @@
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/agentio/sidecar"
+	"github.com/agentio/sidecar/codes"
+	"go.yaml.in/yaml/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Script describes the responses of a mock server.
+//
+// Methods are keyed by their full path (e.g. "/echo.v1.Echo/Get").
+// Unary and client-streaming methods that are not in the script return empty
+// messages, and server-streaming and bidi-streaming methods send no messages.
+type Script struct {
+	Methods map[string]*MethodScript `yaml:"methods"`
+}
+
+// MethodScript describes the behavior of one method.
+type MethodScript struct {
+	// Delay is a pause before the method begins responding.
+	Delay time.Duration `yaml:"delay"`
+	// Responses are messages in their JSON form. Unary and client-streaming
+	// methods return the first response, server-streaming methods return them
+	// all, and bidi-streaming methods reply to each request with the next one,
+	// starting over when the list is exhausted.
+	Responses []*ResponseScript `yaml:"responses"`
+	// Error is returned after any responses have been sent.
+	Error *ErrorScript `yaml:"error"`
+}
+
+// ResponseScript describes a single response message.
+type ResponseScript struct {
+	Delay   time.Duration `yaml:"delay"`
+	Message any           `yaml:"message"`
+}
+
+// ErrorScript describes an error status.
+type ErrorScript struct {
+	// Code is the name (e.g. "NotFound" or "NOT_FOUND") or number of a gRPC status code other than OK.
+	Code    string `yaml:"code"`
+	Message string `yaml:"message"`
+}
+
+// readScript reads a script from a YAML (or JSON) file.
+func readScript(name string) (*Script, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var script Script
+	if err := yaml.Unmarshal(b, &script); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	// Allow method names to be written with or without a leading slash.
+	methods := make(map[string]*MethodScript, len(script.Methods))
+	for name, m := range script.Methods {
+		methods[methodPath(name)] = m
+	}
+	script.Methods = methods
+	return &script, nil
+}
+
+type response struct {
+	delay time.Duration
+	body  []byte
+}
+
+// method holds the compiled behavior of a method.
+type method struct {
+	desc      protoreflect.MethodDescriptor
+	delay     time.Duration
+	responses []response
+	err       error
+}
+
+func compile(desc protoreflect.MethodDescriptor, script *MethodScript) (*method, error) {
+	m := &method{desc: desc}
+	if script == nil {
+		return m, nil
+	}
+	m.delay = script.Delay
+	for i, r := range script.Responses {
+		j, err := json.Marshal(r.Message)
+		if err != nil {
+			return nil, fmt.Errorf("response %d: %w", i, err)
+		}
+		message := dynamicpb.NewMessage(desc.Output())
+		if r.Message != nil {
+			if err := protojson.Unmarshal(j, message); err != nil {
+				return nil, fmt.Errorf("response %d: %w", i, err)
+			}
+		}
+		body, err := proto.Marshal(message)
+		if err != nil {
+			return nil, fmt.Errorf("response %d: %w", i, err)
+		}
+		m.responses = append(m.responses, response{delay: r.Delay, body: body})
+	}
+	if script.Error != nil {
+		// An error with the OK code is a mistake in the script, however it is written.
+		code, ok := codes.Parse(script.Error.Code)
+		if !ok || code == codes.OK {
+			return nil, fmt.Errorf("invalid error code %q", script.Error.Code)
+		}
+		m.err = sidecar.NewError(errors.New(script.Error.Message), code)
+	}
+	return m, nil
+}
+
+func methodPath(name string) string {
+	return "/" + strings.TrimPrefix(name, "/")
+}
+
+// validate checks that a request can be parsed as the method's input type.
+func (m *method) validate(b []byte) error {
+	if err := proto.Unmarshal(b, dynamicpb.NewMessage(m.desc.Input())); err != nil {
+		return sidecar.NewError(fmt.Errorf("invalid %s: %w", m.desc.Input().FullName(), err), codes.InvalidArgument)
+	}
+	return nil
+}
+
+func (m *method) first() []byte {
+	if len(m.responses) == 0 {
+		return []byte{}
+	}
+	return m.responses[0].body
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return sidecar.NewError(ctx.Err(), codes.Canceled)
+	}
+}
@@ -0,0 +1,129 @@
+// Package replay implements replays of recorded calls.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/agentio/sidecar"
+	"github.com/agentio/sidecar/codes"
+	"github.com/spf13/cobra"
+)
+
+// maxLineSize is the largest recorded call that can be read.
+const maxLineSize = 64 * 1024 * 1024
+
+func Cmd() *cobra.Command {
+	var address string
+	var verbose bool
+	var insecure bool
+	cmd := &cobra.Command{
+		Use:  "replay FILE",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			client := sidecar.NewClient(sidecar.ClientOptions{Address: address, Insecure: insecure})
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+			calls, differences := 0, 0
+			for scanner.Scan() {
+				if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+					continue
+				}
+				var recorded sidecar.RecordedCall
+				if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+					return fmt.Errorf("call %d: %w", calls+1, err)
+				}
+				calls++
+				diffs := compare(&recorded, replay(cmd, client, &recorded))
+				if len(diffs) == 0 {
+					if verbose {
+						_, _ = fmt.Fprintf(cmd.OutOrStdout(), "OK   %s\n", recorded.Method)
+					}
+					continue
+				}
+				differences++
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), "DIFF %s\n", recorded.Method)
+				for _, diff := range diffs {
+					_, _ = fmt.Fprintf(cmd.OutOrStdout(), "  %s\n", diff)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "replayed %d calls, %d differed\n", calls, differences)
+			if differences > 0 {
+				return fmt.Errorf("%d of %d replayed calls differed", differences, calls)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&address, "address", "a", "unix:@echo", "address of the echo server to use")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
+	cmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "disable TLS certificate verification")
+	return cmd
+}
+
+// replay reissues a recorded call and records the result.
+// Calls of all four streaming modes are replayed as bidi streams of raw frames.
+func replay(cmd *cobra.Command, client *sidecar.Client, recorded *sidecar.RecordedCall) *sidecar.RecordedCall {
+	result := &sidecar.RecordedCall{Method: recorded.Method}
+	c := *client
+	if recorded.Header != nil {
+		c.Header = recorded.Header.Clone()
+	}
+	stream, err := sidecar.CallBidiStream[[]byte, []byte](cmd.Context(), &c, recorded.Method)
+	if err != nil {
+		return withError(result, err)
+	}
+	for _, request := range recorded.Requests {
+		if err := stream.Send(&request); err != nil {
+			return withError(result, err)
+		}
+	}
+	if err := stream.CloseRequest(); err != nil {
+		return withError(result, err)
+	}
+	for response, err := range stream.All() {
+		if err != nil {
+			return withError(result, err)
+		}
+		result.Responses = append(result.Responses, *response)
+	}
+	return withError(result, nil)
+}
+
+func withError(call *sidecar.RecordedCall, err error) *sidecar.RecordedCall {
+	call.Status = codes.Code(sidecar.ErrorCode(err))
+	if err != nil {
+		call.Message = err.Error()
+	}
+	return call
+}
+
+// compare describes the differences between a recorded call and its replay.
+func compare(recorded, replayed *sidecar.RecordedCall) []string {
+	var diffs []string
+	if recorded.Status != replayed.Status {
+		diffs = append(diffs, fmt.Sprintf("status: recorded %s, replayed %s (%s)",
+			codes.Name(recorded.Status), codes.Name(replayed.Status), replayed.Message))
+	}
+	if len(recorded.Responses) != len(replayed.Responses) {
+		diffs = append(diffs, fmt.Sprintf("responses: recorded %d, replayed %d",
+			len(recorded.Responses), len(replayed.Responses)))
+	}
+	for i := range min(len(recorded.Responses), len(replayed.Responses)) {
+		if !bytes.Equal(recorded.Responses[i], replayed.Responses[i]) {
+			diffs = append(diffs, fmt.Sprintf("response %d: recorded %q, replayed %q",
+				i, recorded.Responses[i], replayed.Responses[i]))
+		}
+	}
+	return diffs
+}
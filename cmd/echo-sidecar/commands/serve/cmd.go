@@ -3,12 +3,12 @@ package serve
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/agentio/sidecar"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/constants"
@@ -20,6 +20,12 @@ func Cmd() *cobra.Command {
 	var port int
 	var socket string
 	var verbose bool
+	var web bool
+	var connect bool
+	var metrics bool
+	var logFormat string
+	var options sidecar.ServerOptions
+	var minPingInterval time.Duration
 	cmd := &cobra.Command{
 		Use:  "serve",
 		Args: cobra.NoArgs,
@@ -29,7 +35,34 @@ func Cmd() *cobra.Command {
 			mux.HandleFunc(constants.EchoExpandProcedure, sidecar.HandleServerStreaming(expand))
 			mux.HandleFunc(constants.EchoCollectProcedure, sidecar.HandleClientStreaming(collect))
 			mux.HandleFunc(constants.EchoUpdateProcedure, sidecar.HandleBidiStreaming(update))
-			server := sidecar.NewServer(mux)
+			var handler http.Handler = mux
+			if verbose {
+				var logHandler slog.Handler
+				switch logFormat {
+				case "json":
+					logHandler = slog.NewJSONHandler(cmd.ErrOrStderr(), nil)
+				case "text":
+					logHandler = slog.NewTextHandler(cmd.ErrOrStderr(), nil)
+				default:
+					return fmt.Errorf("unsupported log format %q", logFormat)
+				}
+				handler = sidecar.HandleStats(handler, sidecar.NewAccessLog(slog.New(logHandler)))
+			}
+			if metrics {
+				stats := sidecar.NewPrometheusStats()
+				handler = sidecar.HandleStats(handler, stats)
+				mux.Handle("/metrics", stats)
+			}
+			if web {
+				handler = sidecar.HandleGRPCWeb(handler)
+			}
+			if connect {
+				handler = sidecar.HandleConnect(handler)
+			}
+			server := sidecar.NewServerWithOptions(handler, options)
+			if web || connect || metrics {
+				server.Protocols.SetHTTP1(true)
+			}
 			var err error
 			var listener net.Listener
 			if port == 0 {
@@ -40,12 +73,30 @@ func Cmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if minPingInterval > 0 {
+				listener = sidecar.EnforcePingInterval(listener, minPingInterval)
+			}
 			return server.Serve(listener)
 		},
 	}
 	cmd.Flags().IntVarP(&port, "port", "p", 0, "server port")
 	cmd.Flags().StringVarP(&socket, "socket", "s", "@echo", "server socket")
-	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "log each call")
+	cmd.Flags().StringVar(&logFormat, "log-format", "text", "format of the call log (text or json)")
+	cmd.Flags().BoolVar(&web, "web", false, "also serve gRPC-Web requests, including over HTTP/1.1")
+	cmd.Flags().BoolVar(&connect, "connect", false, "also serve Connect protocol requests, including over HTTP/1.1")
+	cmd.Flags().BoolVar(&metrics, "metrics", false, "serve Prometheus metrics at /metrics, including over HTTP/1.1")
+	cmd.Flags().DurationVar(&options.PingInterval, "ping-interval", 0, "ping clients after this time without activity")
+	cmd.Flags().DurationVar(&options.PingTimeout, "ping-timeout", 0, "close connections when pings are not answered within this time")
+	cmd.Flags().DurationVar(&options.MaxConnectionIdle, "max-connection-idle", 0, "close connections without calls after this time")
+	cmd.Flags().DurationVar(&options.MaxConnectionAge, "max-connection-age", 0, "close connections gracefully when calls begin after this time")
+	cmd.Flags().DurationVar(&options.MaxConnectionAgeGrace, "max-connection-age-grace", 0, "close connections this long after their maximum age (0 to wait for calls to finish)")
+	cmd.Flags().DurationVar(&minPingInterval, "min-ping-interval", 0, "close connections of clients that ping more often than this")
+	cmd.Flags().IntVar(&options.InitialStreamWindowSize, "initial-stream-window-size", 0, "HTTP/2 flow control window for each stream, in bytes")
+	cmd.Flags().IntVar(&options.InitialConnWindowSize, "initial-conn-window-size", 0, "HTTP/2 flow control window for each connection, in bytes")
+	cmd.Flags().IntVar(&options.MaxFrameSize, "max-frame-size", 0, "largest HTTP/2 frame to read, in bytes")
+	cmd.Flags().IntVar(&options.MaxHeaderListSize, "max-header-list-size", 0, "largest size of request headers to read, in bytes")
+	cmd.Flags().IntVar(&options.MaxConcurrentStreams, "max-concurrent-streams", 0, "number of calls that each connection can make at once")
 	return cmd
 }
 
@@ -67,11 +118,8 @@ func expand(ctx context.Context, req *sidecar.Request[echopb.EchoRequest], strea
 
 func collect(ctx context.Context, stream *sidecar.ClientStream[echopb.EchoRequest]) (*sidecar.Response[echopb.EchoResponse], error) {
 	parts := []string{}
-	for {
-		request, err := stream.Receive()
-		if errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
+	for request, err := range stream.All() {
+		if err != nil {
 			return nil, err
 		}
 		parts = append(parts, request.Text)
@@ -82,11 +130,8 @@ func collect(ctx context.Context, stream *sidecar.ClientStream[echopb.EchoReques
 }
 
 func update(ctx context.Context, stream *sidecar.BidiStream[echopb.EchoRequest, echopb.EchoResponse]) error {
-	for {
-		request, err := stream.Receive()
-		if errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
+	for request, err := range stream.All() {
+		if err != nil {
 			return err
 		}
 		err = stream.Send(&echopb.EchoResponse{Text: "Go echo update: " + request.Text})
@@ -2,12 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/agentio/sidecar"
 	"github.com/agentio/sidecar/cmd/echo-sidecar/commands"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/genproto/echopb"
+	"github.com/agentio/sidecar/cmd/echo-sidecar/track"
+	"github.com/agentio/sidecar/codes"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 func TestSocket(t *testing.T) {
@@ -25,6 +48,2262 @@ func TestLocal(t *testing.T) {
 	)
 }
 
+func TestWeb(t *testing.T) {
+	for port, protocol := range map[string]string{"19873": "grpc", "19874": "grpc-web", "19875": "grpc-web-text"} {
+		t.Run(protocol, func(t *testing.T) {
+			test_service(t,
+				[]string{"serve", "--port", port, "--web"},
+				[]string{"--address", "localhost:" + port, "--protocol", protocol},
+			)
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	test_service(t,
+		[]string{"serve", "--socket", "@echojson"},
+		[]string{"--address", "unix:@echojson", "--codec", "json"},
+	)
+}
+
+type plainRequest struct {
+	Names []string `json:"names"`
+}
+
+type plainResponse struct {
+	Greeting string `json:"greeting"`
+	Count    int    `json:"count"`
+}
+
+func TestPlainTypes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plain.v1.Greeter/Greet", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[plainRequest]) (*sidecar.Response[plainResponse], error) {
+			return sidecar.NewResponse(&plainResponse{
+				Greeting: "hello " + strings.Join(req.Msg.Names, " and "),
+				Count:    len(req.Msg.Names),
+			}), nil
+		}))
+	listener, err := net.Listen("unix", "@echoplain")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echoplain", Codec: sidecar.JSONCodec{}})
+	response, err := sidecar.CallUnary[plainRequest, plainResponse](
+		t.Context(),
+		client,
+		"/plain.v1.Greeter/Greet",
+		sidecar.NewRequest(&plainRequest{Names: []string{"alice", "bob"}}),
+	)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if response.Msg.Greeting != "hello alice and bob" || response.Msg.Count != 2 {
+		t.Errorf("unexpected response %+v", response.Msg)
+	}
+	// Plain types can't be sent with the default protobuf codec.
+	client = sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echoplain"})
+	_, err = sidecar.CallUnary[plainRequest, plainResponse](
+		t.Context(),
+		client,
+		"/plain.v1.Greeter/Greet",
+		sidecar.NewRequest(&plainRequest{}),
+	)
+	if sidecar.ErrorCode(err) != int(codes.InvalidArgument) {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+	// Codecs can't replace registered codecs with the same name.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected RegisterCodec to panic for a duplicate name")
+			}
+		}()
+		sidecar.RegisterCodec(sidecar.ProtoJSONCodec{})
+	}()
+}
+
+func TestConnect(t *testing.T) {
+	const port = "19876"
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"serve", "--port", port, "--connect"})
+		err := serveCmd.Execute()
+		if err != nil {
+			log.Printf("failed to read output from buffer: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tests := []struct {
+		Method      string
+		ContentType string
+		Body        string
+		Status      int
+		Expected    string
+		Contains    string
+	}{
+		{
+			Method:      "Get",
+			ContentType: "application/json",
+			Body:        `{"text":"hello"}`,
+			Status:      http.StatusOK,
+			Expected:    `{"text":"Go echo get: hello"}`,
+		},
+		{
+			Method:      "Get",
+			ContentType: "application/proto",
+			Body:        "\x0a\x05hello",
+			Status:      http.StatusOK,
+			Expected:    "\x0a\x12Go echo get: hello",
+		},
+		{
+			Method:      "Get",
+			ContentType: "application/json",
+			Body:        `{"txt":"hello"}`,
+			Status:      http.StatusBadRequest,
+			Expected:    `{"code":"invalid_argument","message":"failed to unmarshal *echopb.EchoRequest`,
+		},
+		{
+			Method:      "Missing",
+			ContentType: "application/json",
+			Body:        `{}`,
+			Status:      http.StatusNotImplemented,
+			Expected:    `{"code":"unimplemented","message":"404 page not found"}` + "\n",
+		},
+		{
+			Method:      "Expand",
+			ContentType: "application/connect+json",
+			Body:        "\x00\x00\x00\x00\x0e" + `{"text":"1 2"}`,
+			Status:      http.StatusOK,
+			Expected: "\x00\x00\x00\x00\x1c" + `{"text":"Go echo expand: 1"}` +
+				"\x00\x00\x00\x00\x1c" + `{"text":"Go echo expand: 2"}` +
+				"\x02\x00\x00\x00\x02" + `{}`,
+		},
+		{
+			Method:      "Expand",
+			ContentType: "application/connect+json",
+			Body:        "\x00\x00\x00\x00\x02" + `{]`,
+			Status:      http.StatusOK,
+			Expected:    "\x02\x00\x00\x00",
+			Contains:    `{"error":{"code":"invalid_argument","message":"failed to unmarshal *echopb.EchoRequest`,
+		},
+	}
+	for _, test := range tests {
+		resp, err := http.Post("http://localhost:"+port+"/echo.v1.Echo/"+test.Method, test.ContentType, strings.NewReader(test.Body))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if resp.StatusCode != test.Status {
+			t.Errorf("%s: expected status %d, got %d", test.Method, test.Status, resp.StatusCode)
+		}
+		// Error messages from protojson are unstable, so they are only checked by prefix.
+		if test.Status == http.StatusBadRequest || test.Contains != "" {
+			if !strings.HasPrefix(string(body), test.Expected) || !strings.Contains(string(body), test.Contains) {
+				t.Errorf("%s: expected %q...%q, got %q", test.Method, test.Expected, test.Contains, string(body))
+			}
+		} else if string(body) != test.Expected {
+			t.Errorf("%s: expected %q, got %q", test.Method, test.Expected, string(body))
+		}
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	const port = "19877"
+	go func() {
+		serveCmd := commands.Cmd()
+		// The gRPC-Web option enables HTTP/1.1, which the default HTTP client uses.
+		serveCmd.SetArgs([]string{"serve", "--port", port, "--web"})
+		err := serveCmd.Execute()
+		if err != nil {
+			log.Printf("failed to read output from buffer: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	url := "http://localhost:" + port + "/echo.v1.Echo/Get"
+	tests := []struct {
+		Method      string
+		ContentType string
+		Status      int
+		GrpcStatus  string
+	}{
+		{Method: http.MethodGet, Status: http.StatusMethodNotAllowed},
+		{Method: http.MethodPost, ContentType: "text/plain", Status: http.StatusUnsupportedMediaType},
+		{Method: http.MethodPost, ContentType: "application/grpcfoo", Status: http.StatusUnsupportedMediaType},
+		{Method: http.MethodPost, ContentType: "application/grpc", Status: http.StatusOK, GrpcStatus: "13"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.Method, url, strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if test.ContentType != "" {
+			req.Header.Set("Content-Type", test.ContentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != test.Status {
+			t.Errorf("%s %q: expected status %d, got %d", test.Method, test.ContentType, test.Status, resp.StatusCode)
+		}
+		if status := resp.Header.Get("Grpc-Status"); status != test.GrpcStatus {
+			t.Errorf("%s %q: expected grpc-status %q, got %q", test.Method, test.ContentType, test.GrpcStatus, status)
+		}
+	}
+	// HTTP errors for gRPC-Web requests are passed through unchanged.
+	for _, contentType := range []string{"application/grpc-web", "application/grpc-web-text"} {
+		resp, err := http.Post("http://localhost:"+port+"/echo.v1.Echo/Missing", contentType, strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || string(body) != "404 page not found\n" {
+			t.Errorf("%q: expected status %d and a plain body, got %d %q", contentType, http.StatusNotFound, resp.StatusCode, body)
+		}
+	}
+	// An unknown codec is reported with a trailers-only response.
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "localhost:" + port, Codec: unknownCodec{}})
+	_, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](
+		t.Context(),
+		client,
+		"/echo.v1.Echo/Get",
+		sidecar.NewRequest(&echopb.EchoRequest{}),
+	)
+	if sidecar.ErrorCode(err) != int(codes.Internal) {
+		t.Errorf("expected Internal, got %v", err)
+	}
+	// Errors returned before any messages are sent have their status in the header.
+	client = sidecar.NewClient(sidecar.ClientOptions{Address: "localhost:" + port})
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte{0, 0, 0, 0, 2, 0xff, 0xff}))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if status := resp.Header.Get("Grpc-Status"); status != "3" {
+		t.Errorf("expected grpc-status 3 in header, got %q", status)
+	}
+	if len(resp.Trailer) != 0 {
+		t.Errorf("expected no trailers, got %v", resp.Trailer)
+	}
+	// Compressed messages are unimplemented.
+	req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte{1, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err = client.HttpClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if status := resp.Header.Get("Grpc-Status"); status != "12" {
+		t.Errorf("expected grpc-status 12 for a compressed message, got %q", status)
+	}
+	// Responses that can't be encoded are also reported with trailers-only responses.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Unencodable/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[plainResponse], error) {
+			return sidecar.NewResponse(&plainResponse{}), nil
+		}))
+	mux.HandleFunc("/test.Unencodable/Expand", sidecar.HandleServerStreaming(
+		func(ctx context.Context, req *sidecar.Request[[]byte], stream *sidecar.ServerStream[plainResponse]) error {
+			return stream.Send(&plainResponse{})
+		}))
+	listener, err := net.Listen("unix", "@echounencodable")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+	client = sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echounencodable"})
+	for _, method := range []string{"Get", "Expand"} {
+		req, err := http.NewRequest(http.MethodPost, client.Host+"/test.Unencodable/"+method, bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.HttpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if status := resp.Header.Get("Grpc-Status"); status != "3" {
+			t.Errorf("%s: expected grpc-status 3 in header, got %q", method, status)
+		}
+		if len(resp.Trailer) != 0 {
+			t.Errorf("%s: expected no trailers, got %v", method, resp.Trailer)
+		}
+	}
+}
+
+type unknownCodec struct{ sidecar.ProtoCodec }
+
+func (unknownCodec) Name() string { return "unknown" }
+
+func TestHTTPStatus(t *testing.T) {
+	// This server acts like a proxy that replies without a gRPC status.
+	listener, err := net.Listen("unix", "@echohttp")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		http.Error(w, "upstream says no", status)
+	}))
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echohttp"})
+	tests := []struct {
+		Status int
+		Code   codes.Code
+	}{
+		{Status: http.StatusBadRequest, Code: codes.Internal},
+		{Status: http.StatusUnauthorized, Code: codes.Unauthenticated},
+		{Status: http.StatusForbidden, Code: codes.PermissionDenied},
+		{Status: http.StatusNotFound, Code: codes.Unimplemented},
+		{Status: http.StatusTooManyRequests, Code: codes.Unavailable},
+		{Status: http.StatusBadGateway, Code: codes.Unavailable},
+		{Status: http.StatusServiceUnavailable, Code: codes.Unavailable},
+		{Status: http.StatusGatewayTimeout, Code: codes.Unavailable},
+		{Status: http.StatusTeapot, Code: codes.Unknown},
+	}
+	for _, test := range tests {
+		method := "/" + strconv.Itoa(test.Status)
+		_, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](
+			t.Context(),
+			client,
+			method,
+			sidecar.NewRequest(&echopb.EchoRequest{}),
+		)
+		if sidecar.ErrorCode(err) != int(test.Code) {
+			t.Errorf("%d: expected %s, got %v", test.Status, codes.Name(test.Code), err)
+		}
+		expected := "unexpected HTTP status " + strconv.Itoa(test.Status) + " " + http.StatusText(test.Status) + ": upstream says no"
+		if err == nil || err.Error() != expected {
+			t.Errorf("%d: expected %q, got %v", test.Status, expected, err)
+		}
+		stream, err := sidecar.CallBidiStream[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, method)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		_ = stream.CloseRequest()
+		if _, err := stream.Receive(); sidecar.ErrorCode(err) != int(test.Code) {
+			t.Errorf("%d: expected %s from stream, got %v", test.Status, codes.Name(test.Code), err)
+		}
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	listener, err := net.Listen("unix", "@echoslow")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	// This server ends its responses in the middle of a message.
+	truncatedListener, err := net.Listen("unix", "@echotruncated")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	truncated := sidecar.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = w.Write([]byte{0, 0, 0, 0, 10, 1, 2, 3})
+	}))
+	go func() { _ = truncated.Serve(truncatedListener) }()
+	defer truncated.Close()
+	cancelled, cancel := context.WithCancel(t.Context())
+	cancel()
+	slow, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	tests := []struct {
+		Name    string
+		Ctx     context.Context
+		Address string
+		Code    codes.Code
+	}{
+		{Name: "refused", Ctx: t.Context(), Address: "unix:@echonowhere", Code: codes.Unavailable},
+		{Name: "cancelled", Ctx: cancelled, Address: "unix:@echoslow", Code: codes.Canceled},
+		{Name: "deadline", Ctx: slow, Address: "unix:@echoslow", Code: codes.DeadlineExceeded},
+		{Name: "truncated", Ctx: t.Context(), Address: "unix:@echotruncated", Code: codes.Internal},
+	}
+	for _, test := range tests {
+		client := sidecar.NewClient(sidecar.ClientOptions{Address: test.Address})
+		_, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](
+			test.Ctx,
+			client,
+			"/echo.v1.Echo/Get",
+			sidecar.NewRequest(&echopb.EchoRequest{}),
+		)
+		if sidecar.ErrorCode(err) != int(test.Code) {
+			t.Errorf("%s: expected %s, got %v", test.Name, codes.Name(test.Code), err)
+		}
+		var e *sidecar.Error
+		if errors.As(err, &e) && e.Unwrap() == nil {
+			t.Errorf("%s: expected the transport error to be preserved", test.Name)
+		}
+		serverStream, err := sidecar.CallServerStream[echopb.EchoRequest, echopb.EchoResponse](
+			test.Ctx,
+			client,
+			"/echo.v1.Echo/Expand",
+			sidecar.NewRequest(&echopb.EchoRequest{}),
+		)
+		if err == nil {
+			_, err = serverStream.Receive()
+		}
+		if sidecar.ErrorCode(err) != int(test.Code) {
+			t.Errorf("%s: expected %s from server stream, got %v", test.Name, codes.Name(test.Code), err)
+		}
+		stream, err := sidecar.CallClientStream[echopb.EchoRequest, echopb.EchoResponse](test.Ctx, client, "/echo.v1.Echo/Collect")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := stream.CloseAndReceive(); sidecar.ErrorCode(err) != int(test.Code) {
+			t.Errorf("%s: expected %s from client stream, got %v", test.Name, codes.Name(test.Code), err)
+		}
+	}
+}
+
+func TestBidiCancel(t *testing.T) {
+	listener, err := net.Listen("unix", "@echocancel")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	cancelled := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo.v1.Echo/Update", sidecar.HandleBidiStreaming(
+		func(ctx context.Context, stream *sidecar.BidiStream[[]byte, []byte]) error {
+			for {
+				msg, err := stream.Receive()
+				if err != nil {
+					<-stream.Context().Done()
+					cancelled <- err
+					return err
+				}
+				if err := stream.Send(msg); err != nil {
+					return err
+				}
+			}
+		}))
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echocancel"})
+	stream, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/echo.v1.Echo/Update")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	msg := []byte("hello")
+	if err := stream.Send(&msg); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := stream.Receive(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	stream.Cancel()
+	if err := stream.Send(&msg); sidecar.ErrorCode(err) != int(codes.Canceled) {
+		t.Errorf("expected Canceled from Send, got %v", err)
+	}
+	if _, err := stream.Receive(); sidecar.ErrorCode(err) != int(codes.Canceled) {
+		t.Errorf("expected Canceled from Receive, got %v", err)
+	}
+	select {
+	case err := <-cancelled:
+		if sidecar.ErrorCode(err) != int(codes.Canceled) {
+			t.Errorf("expected Canceled on the server, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("server context was not cancelled")
+	}
+	// Failures to connect are returned from Send and Receive.
+	client = sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echonowhere"})
+	stream, err = sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/echo.v1.Echo/Update")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := stream.Send(&msg); sidecar.ErrorCode(err) != int(codes.Unavailable) {
+		t.Errorf("expected Unavailable from Send, got %v", err)
+	}
+	if _, err := stream.Receive(); sidecar.ErrorCode(err) != int(codes.Unavailable) {
+		t.Errorf("expected Unavailable from Receive, got %v", err)
+	}
+	if err := stream.CloseResponse(); sidecar.ErrorCode(err) != int(codes.Unavailable) {
+		t.Errorf("expected Unavailable from CloseResponse, got %v", err)
+	}
+}
+
+func TestIteratorBreak(t *testing.T) {
+	// The handlers send messages until their contexts are cancelled.
+	cancelled := make(chan string, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Break/Expand", sidecar.HandleServerStreaming(
+		func(ctx context.Context, req *sidecar.Request[[]byte], stream *sidecar.ServerStream[[]byte]) error {
+			for ctx.Err() == nil {
+				if err := stream.Send(req.Msg); err != nil {
+					break
+				}
+			}
+			<-ctx.Done()
+			cancelled <- "Expand"
+			return ctx.Err()
+		}))
+	mux.HandleFunc("/test.Break/Update", sidecar.HandleBidiStreaming(
+		func(ctx context.Context, stream *sidecar.BidiStream[[]byte, []byte]) error {
+			msg, err := stream.Receive()
+			for err == nil {
+				err = stream.Send(msg)
+			}
+			<-ctx.Done()
+			cancelled <- "Update"
+			return ctx.Err()
+		}))
+	listener, err := net.Listen("unix", "@echobreak")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echobreak"})
+	msg := []byte("hello")
+	serverStream, err := sidecar.CallServerStream[[]byte, []byte](t.Context(), client, "/test.Break/Expand", sidecar.NewRequest(&msg))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, err := range serverStream.All() {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		break
+	}
+	bidiStream, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.Break/Update")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := bidiStream.Send(&msg); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, err := range bidiStream.All() {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		break
+	}
+	// Breaking out of the loops cancels the calls.
+	for range 2 {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatalf("server context was not cancelled")
+		}
+	}
+}
+
+func TestStress(t *testing.T) {
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"serve", "--socket", "@echostress"})
+		err := serveCmd.Execute()
+		if err != nil {
+			log.Printf("failed to read output from buffer: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	streams, concurrency := 2000, 400
+	if testing.Short() {
+		streams = 200
+	}
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echostress"})
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range streams {
+		semaphore <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-semaphore }()
+			var err error
+			if i%2 == 0 {
+				err = stressBidi(t.Context(), client, i)
+			} else {
+				err = stressClientStream(t.Context(), client, i)
+			}
+			if err != nil {
+				t.Errorf("stream %d: %s", i, err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// stressBidi sends and receives on a bidi stream from separate goroutines.
+func stressBidi(ctx context.Context, client *sidecar.Client, i int) error {
+	const n = 5
+	stream, err := sidecar.CallBidiStream[echopb.EchoRequest, echopb.EchoResponse](ctx, client, "/echo.v1.Echo/Update")
+	if err != nil {
+		return err
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		for range n {
+			if err := stream.Send(&echopb.EchoRequest{Text: strconv.Itoa(i)}); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+	received := 0
+	for response, err := range stream.All() {
+		if err != nil {
+			return err
+		}
+		if response.Text != "Go echo update: "+strconv.Itoa(i) {
+			return fmt.Errorf("unexpected response %q", response.Text)
+		}
+		received++
+	}
+	if err := <-sendErr; err != nil {
+		return err
+	}
+	if received != n {
+		return fmt.Errorf("expected %d responses, got %d", n, received)
+	}
+	return nil
+}
+
+// stressClientStream sends on a client stream from several goroutines.
+func stressClientStream(ctx context.Context, client *sidecar.Client, i int) error {
+	const n = 5
+	stream, err := sidecar.CallClientStream[echopb.EchoRequest, echopb.EchoResponse](ctx, client, "/echo.v1.Echo/Collect")
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for range n {
+		wg.Go(func() {
+			errs <- stream.Send(&echopb.EchoRequest{Text: strconv.Itoa(i)})
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	response, err := stream.CloseAndReceive()
+	if err != nil {
+		return err
+	}
+	expected := "Go echo collect:" + strings.Repeat(" "+strconv.Itoa(i), n)
+	if response.Text != expected {
+		return fmt.Errorf("expected %q, got %q", expected, response.Text)
+	}
+	return nil
+}
+
+const retry_config = `{
+  "methodConfig": [
+    {
+      "name": [{"service": "test.Retry"}],
+      "retryPolicy": {
+        "maxAttempts": 4,
+        "initialBackoff": "0.01s",
+        "maxBackoff": "0.05s",
+        "backoffMultiplier": 2,
+        "retryableStatusCodes": ["UNAVAILABLE"]
+      }
+    },
+    {
+      "name": [{"service": "test.Hedge", "method": "Get"}, {"service": "test.Hedge", "method": "Pushback"}],
+      "hedgingPolicy": {
+        "maxAttempts": 3,
+        "hedgingDelay": "0.02s",
+        "nonFatalStatusCodes": ["UNAVAILABLE"]
+      }
+    }
+  ]
+}`
+
+func TestRetry(t *testing.T) {
+	listener, err := net.Listen("unix", "@echoretry")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	attempts := map[string]*atomic.Int32{}
+	for _, name := range []string{"Get", "Pushback", "Fatal", "Expand", "Hedge", "HedgePushback"} {
+		attempts[name] = new(atomic.Int32)
+	}
+	fail := func(w http.ResponseWriter, code codes.Code, pushback string) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+		if pushback != "" {
+			w.Header().Set("Grpc-Retry-Pushback-Ms", pushback)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	echo := sidecar.HandleUnary(func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+		return sidecar.NewResponse(req.Msg), nil
+	})
+	expand := sidecar.HandleServerStreaming(func(ctx context.Context, req *sidecar.Request[[]byte], stream *sidecar.ServerStream[[]byte]) error {
+		for range 2 {
+			if err := stream.Send(req.Msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Retry/Get", func(w http.ResponseWriter, r *http.Request) {
+		if attempts["Get"].Add(1) < 3 {
+			fail(w, codes.Unavailable, "")
+			return
+		}
+		echo(w, r)
+	})
+	mux.HandleFunc("/test.Retry/Pushback", func(w http.ResponseWriter, r *http.Request) {
+		attempts["Pushback"].Add(1)
+		fail(w, codes.Unavailable, "-1")
+	})
+	mux.HandleFunc("/test.Retry/Fatal", func(w http.ResponseWriter, r *http.Request) {
+		attempts["Fatal"].Add(1)
+		fail(w, codes.NotFound, "")
+	})
+	mux.HandleFunc("/test.Retry/Expand", func(w http.ResponseWriter, r *http.Request) {
+		switch attempts["Expand"].Add(1) {
+		case 1:
+			fail(w, codes.Unavailable, "10")
+		case 2:
+			// The stream fails after its header is sent, but before any messages.
+			w.Header().Set("Content-Type", "application/grpc")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(codes.Unavailable)))
+		default:
+			expand(w, r)
+		}
+	})
+	mux.HandleFunc("/test.Hedge/Get", func(w http.ResponseWriter, r *http.Request) {
+		if attempts["Hedge"].Add(1) == 1 {
+			// The first attempt is slow, so a hedged attempt should win.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		echo(w, r)
+	})
+	mux.HandleFunc("/test.Hedge/Pushback", func(w http.ResponseWriter, r *http.Request) {
+		attempts["HedgePushback"].Add(1)
+		fail(w, codes.Unavailable, "-1")
+	})
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	config, err := sidecar.ParseServiceConfig([]byte(retry_config))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echoretry", ServiceConfig: config})
+	msg := []byte("hello")
+	tests := []struct {
+		Name     string
+		Code     codes.Code
+		Attempts int32
+	}{
+		{Name: "Get", Code: codes.OK, Attempts: 3},
+		{Name: "Pushback", Code: codes.Unavailable, Attempts: 1},
+		{Name: "Fatal", Code: codes.NotFound, Attempts: 1},
+	}
+	for _, test := range tests {
+		_, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Retry/"+test.Name, sidecar.NewRequest(&msg))
+		if sidecar.ErrorCode(err) != int(test.Code) {
+			t.Errorf("%s: expected %s, got %v", test.Name, codes.Name(test.Code), err)
+		}
+		if n := attempts[test.Name].Load(); n != test.Attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.Name, test.Attempts, n)
+		}
+	}
+	stream, err := sidecar.CallServerStream[[]byte, []byte](t.Context(), client, "/test.Retry/Expand", sidecar.NewRequest(&msg))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	received := 0
+	for response, err := range stream.All() {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if string(*response) != "hello" {
+			t.Errorf("expected %q, got %q", "hello", *response)
+		}
+		received++
+	}
+	if received != 2 || attempts["Expand"].Load() != 3 {
+		t.Errorf("expected 2 responses after 3 attempts, got %d after %d", received, attempts["Expand"].Load())
+	}
+	start := time.Now()
+	response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Hedge/Get", sidecar.NewRequest(&msg))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if string(*response.Msg) != "hello" || time.Since(start) > time.Second {
+		t.Errorf("expected a fast hedged response, got %q after %s", *response.Msg, time.Since(start))
+	}
+	if n := attempts["Hedge"].Load(); n < 2 {
+		t.Errorf("expected a hedged attempt, got %d attempts", n)
+	}
+	// Hedged calls end when the server asks for no more attempts.
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	_, err = sidecar.CallUnary[[]byte, []byte](ctx, client, "/test.Hedge/Pushback", sidecar.NewRequest(&msg))
+	if sidecar.ErrorCode(err) != int(codes.Unavailable) {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+	if n := attempts["HedgePushback"].Load(); n != 1 {
+		t.Errorf("expected 1 attempt after a pushback, got %d", n)
+	}
+	// Invalid policies are rejected.
+	if _, err := sidecar.ParseServiceConfig([]byte(`{"methodConfig":[{"retryPolicy":{"maxAttempts":1}}]}`)); err == nil {
+		t.Errorf("expected an error for an invalid retry policy")
+	}
+}
+
+// countingStream counts the messages that pass through a stream.
+type countingStream struct {
+	sidecar.MessageStream
+	count *atomic.Int32
+}
+
+func (s *countingStream) Send(msg any) error {
+	s.count.Add(1)
+	return s.MessageStream.Send(msg)
+}
+
+func (s *countingStream) Receive() (any, error) {
+	msg, err := s.MessageStream.Receive()
+	if err == nil {
+		s.count.Add(1)
+	}
+	return msg, err
+}
+
+func TestInterceptors(t *testing.T) {
+	listener, err := net.Listen("unix", "@echointercept")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var mu sync.Mutex
+	var calls []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, s)
+	}
+	// The first server interceptor records calls and the second checks a header.
+	serverMessages := new(atomic.Int32)
+	audit := sidecar.ServerInterceptor{
+		Unary: func(next sidecar.UnaryFunc) sidecar.UnaryFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo, req any) (any, error) {
+				record("server " + info.Method)
+				return next(ctx, info, req)
+			}
+		},
+		Stream: func(next sidecar.StreamFunc) sidecar.StreamFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo, stream sidecar.MessageStream) error {
+				record("server " + info.Method)
+				return next(ctx, info, &countingStream{MessageStream: stream, count: serverMessages})
+			}
+		},
+	}
+	authorize := func(info *sidecar.CallInfo) error {
+		if info.Header.Get("X-Claims") != "ok" {
+			return sidecar.NewError(errors.New("missing claims"), codes.PermissionDenied)
+		}
+		return nil
+	}
+	auth := sidecar.ServerInterceptor{
+		Unary: func(next sidecar.UnaryFunc) sidecar.UnaryFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo, req any) (any, error) {
+				if err := authorize(info); err != nil {
+					return nil, err
+				}
+				return next(ctx, info, req)
+			}
+		},
+		Stream: func(next sidecar.StreamFunc) sidecar.StreamFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo, stream sidecar.MessageStream) error {
+				if err := authorize(info); err != nil {
+					return err
+				}
+				return next(ctx, info, stream)
+			}
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Intercept/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			return sidecar.NewResponse(req.Msg), nil
+		}, audit, auth))
+	mux.HandleFunc("/test.Intercept/Expand", sidecar.HandleServerStreaming(
+		func(ctx context.Context, req *sidecar.Request[[]byte], stream *sidecar.ServerStream[[]byte]) error {
+			for range 2 {
+				if err := stream.Send(req.Msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, audit, auth))
+	mux.HandleFunc("/test.Intercept/Collect", sidecar.HandleClientStreaming(
+		func(ctx context.Context, stream *sidecar.ClientStream[[]byte]) (*sidecar.Response[[]byte], error) {
+			var all []byte
+			for msg, err := range stream.All() {
+				if err != nil {
+					return nil, err
+				}
+				all = append(all, *msg...)
+			}
+			return sidecar.NewResponse(&all), nil
+		}, audit, auth))
+	mux.HandleFunc("/test.Intercept/Update", sidecar.HandleBidiStreaming(
+		func(ctx context.Context, stream *sidecar.BidiStream[[]byte, []byte]) error {
+			for msg, err := range stream.All() {
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, audit, auth))
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	// The first client interceptor records calls and the second adds a header.
+	clientMessages := new(atomic.Int32)
+	trace := sidecar.ClientInterceptor{
+		Unary: func(next sidecar.UnaryFunc) sidecar.UnaryFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo, req any) (any, error) {
+				record("client " + info.Method)
+				return next(ctx, info, req)
+			}
+		},
+		Stream: func(next sidecar.StreamStartFunc) sidecar.StreamStartFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo) (sidecar.MessageStream, error) {
+				record("client " + info.Method)
+				stream, err := next(ctx, info)
+				if err != nil {
+					return nil, err
+				}
+				return &countingStream{MessageStream: stream, count: clientMessages}, nil
+			}
+		},
+	}
+	claims := sidecar.ClientInterceptor{
+		Unary: func(next sidecar.UnaryFunc) sidecar.UnaryFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo, req any) (any, error) {
+				info.Header.Set("X-Claims", "ok")
+				return next(ctx, info, req)
+			}
+		},
+		Stream: func(next sidecar.StreamStartFunc) sidecar.StreamStartFunc {
+			return func(ctx context.Context, info *sidecar.CallInfo) (sidecar.MessageStream, error) {
+				info.Header.Set("X-Claims", "ok")
+				return next(ctx, info)
+			}
+		},
+	}
+	client := sidecar.NewClient(sidecar.ClientOptions{
+		Address:      "unix:@echointercept",
+		Interceptors: []sidecar.ClientInterceptor{trace, claims},
+	})
+	msg := []byte("a")
+	response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Intercept/Get", sidecar.NewRequest(&msg))
+	if err != nil || string(*response.Msg) != "a" {
+		t.Errorf("unexpected unary result %v %v", response, err)
+	}
+	expand, err := sidecar.CallServerStream[[]byte, []byte](t.Context(), client, "/test.Intercept/Expand", sidecar.NewRequest(&msg))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, err := range expand.All() {
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+	collect, err := sidecar.CallClientStream[[]byte, []byte](t.Context(), client, "/test.Intercept/Collect")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for range 3 {
+		if err := collect.Send(&msg); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if response, err := collect.CloseAndReceive(); err != nil || string(*response) != "aaa" {
+		t.Errorf("unexpected client-streaming result %v %v", response, err)
+	}
+	update, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.Intercept/Update")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for range 2 {
+		if err := update.Send(&msg); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := update.Receive(); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	_ = update.CloseSend()
+	for _, err := range update.All() {
+		if err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+	expected := []string{
+		"client /test.Intercept/Get", "server /test.Intercept/Get",
+		"client /test.Intercept/Expand", "server /test.Intercept/Expand",
+		"client /test.Intercept/Collect", "server /test.Intercept/Collect",
+		"client /test.Intercept/Update", "server /test.Intercept/Update",
+	}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+	// Stream messages: expand 1+2, collect 3+1, update 2+2.
+	if n := clientMessages.Load(); n != 11 {
+		t.Errorf("expected 11 messages through client interceptors, got %d", n)
+	}
+	if n := serverMessages.Load(); n != 11 {
+		t.Errorf("expected 11 messages through server interceptors, got %d", n)
+	}
+	// Calls without the claims interceptor are rejected.
+	client = sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echointercept"})
+	_, err = sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Intercept/Get", sidecar.NewRequest(&msg))
+	if sidecar.ErrorCode(err) != int(codes.PermissionDenied) {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+	update, err = sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.Intercept/Update")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	_ = update.CloseSend()
+	if _, err := update.Receive(); sidecar.ErrorCode(err) != int(codes.PermissionDenied) {
+		t.Errorf("expected PermissionDenied from stream, got %v", err)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	// The backend returns the tracing headers that it receives.
+	backendListener, err := net.Listen("unix", "@echobackend")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	backendMux := http.NewServeMux()
+	backendMux.HandleFunc("/test.Trace/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			header, _ := sidecar.IncomingHeader(ctx)
+			var b []byte
+			for _, key := range []string{"Traceparent", "Tracestate", "X-Request-Id", "X-Custom"} {
+				b = fmt.Appendf(b, "%s=%s;", key, header.Get(key))
+			}
+			return sidecar.NewResponse(&b), nil
+		}))
+	backend := sidecar.NewServer(backendMux)
+	go func() { _ = backend.Serve(backendListener) }()
+	defer backend.Close()
+	// The frontend calls the backend with the context of each request, using
+	// the default headers or the ones that are named in the request.
+	frontendListener, err := net.Listen("unix", "@echofrontend")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	frontendMux := http.NewServeMux()
+	frontendMux.HandleFunc("/test.Trace/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			var names []string
+			if len(*req.Msg) > 0 {
+				names = strings.Split(string(*req.Msg), ",")
+			}
+			client := sidecar.NewClient(sidecar.ClientOptions{
+				Address:           "unix:@echobackend",
+				PropagatedHeaders: names,
+			})
+			msg := []byte{}
+			response, err := sidecar.CallUnary[[]byte, []byte](ctx, client, "/test.Trace/Get", sidecar.NewRequest(&msg))
+			if err != nil {
+				return nil, err
+			}
+			return sidecar.NewResponse(response.Msg), nil
+		}))
+	frontend := sidecar.NewServer(frontendMux)
+	go func() { _ = frontend.Serve(frontendListener) }()
+	defer frontend.Close()
+	client := sidecar.NewClient(sidecar.ClientOptions{
+		Address: "unix:@echofrontend",
+		Headers: []string{
+			"traceparent: 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			"tracestate: congo=t61rcWkgMzE",
+			"x-request-id: 1234",
+			"x-custom: abc",
+		},
+	})
+	for _, test := range []struct {
+		names    string
+		expected string
+	}{
+		{"", "Traceparent=00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01;Tracestate=congo=t61rcWkgMzE;X-Request-Id=1234;X-Custom=;"},
+		{"x-request-id,x-custom", "Traceparent=;Tracestate=;X-Request-Id=1234;X-Custom=abc;"},
+	} {
+		msg := []byte(test.names)
+		response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Trace/Get", sidecar.NewRequest(&msg))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if string(*response.Msg) != test.expected {
+			t.Errorf("with headers %q, expected %s, got %s", test.names, test.expected, *response.Msg)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	const port = "19878"
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"serve", "--port", port, "--metrics"})
+		if err := serveCmd.Execute(); err != nil {
+			log.Printf("%s", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	stats := sidecar.NewPrometheusStats()
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "localhost:" + port, StatsHandler: stats})
+	_, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, "/echo.v1.Echo/Get",
+		sidecar.NewRequest(&echopb.EchoRequest{Text: "hello"}))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	stream, err := sidecar.CallServerStream[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, "/echo.v1.Echo/Expand",
+		sidecar.NewRequest(&echopb.EchoRequest{Text: "a b c"}))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, err := range stream.All() {
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	_, err = sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, "/echo.v1.Echo/Missing",
+		sidecar.NewRequest(&echopb.EchoRequest{}))
+	if sidecar.ErrorCode(err) != int(codes.Unimplemented) {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+	var clientMetrics strings.Builder
+	if err := stats.WriteMetrics(&clientMetrics); err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp, err := http.Get("http://localhost:" + port + "/metrics")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer resp.Body.Close()
+	serverMetrics, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for side, metrics := range map[string]string{"client": clientMetrics.String(), "server": string(serverMetrics)} {
+		sent, received := "msg_sent", "msg_received"
+		if side == "server" {
+			sent, received = received, sent
+		}
+		for _, expected := range []string{
+			`started_total{grpc_service="echo.v1.Echo",grpc_method="Get"} 1`,
+			`handled_total{grpc_service="echo.v1.Echo",grpc_method="Get",grpc_code="OK"} 1`,
+			`handled_total{grpc_service="echo.v1.Echo",grpc_method="Expand",grpc_code="OK"} 1`,
+			sent + `_total{grpc_service="echo.v1.Echo",grpc_method="Expand"} 1`,
+			received + `_total{grpc_service="echo.v1.Echo",grpc_method="Expand"} 3`,
+			sent + `_bytes_total{grpc_service="echo.v1.Echo",grpc_method="Get"} 7`,
+			received + `_bytes_total{grpc_service="echo.v1.Echo",grpc_method="Get"} 20`,
+			`handling_seconds_bucket{grpc_service="echo.v1.Echo",grpc_method="Get",le="+Inf"} 1`,
+			`handling_seconds_count{grpc_service="echo.v1.Echo",grpc_method="Expand"} 1`,
+		} {
+			if expected = "grpc_" + side + "_" + expected; !strings.Contains(metrics, expected+"\n") {
+				t.Errorf("missing %s metric %s", side, expected)
+			}
+		}
+	}
+	if strings.Contains(string(serverMetrics), `grpc_service="metrics"`) {
+		t.Errorf("metrics requests should not be reported")
+	}
+	// Servers group the calls of methods without handlers, since clients can choose any path.
+	for metrics, expected := range map[string]string{
+		clientMetrics.String(): `grpc_client_handled_total{grpc_service="echo.v1.Echo",grpc_method="Missing",grpc_code="Unimplemented"} 1`,
+		string(serverMetrics):  `grpc_server_handled_total{grpc_service="unknown",grpc_method="",grpc_code="Unimplemented"} 1`,
+	} {
+		if !strings.Contains(metrics, expected+"\n") {
+			t.Errorf("missing metric %s", expected)
+		}
+	}
+	if strings.Contains(string(serverMetrics), `grpc_method="Missing"`) {
+		t.Errorf("methods without handlers should not be reported by name")
+	}
+}
+
+// lockedBuffer is a buffer that can be written by a server while a test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	var log lockedBuffer
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"serve", "--socket", "@echolog", "--verbose", "--log-format", "json"})
+		serveCmd.SetErr(&log)
+		_ = serveCmd.Execute()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echolog"})
+	stream, err := sidecar.CallClientStream[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, "/echo.v1.Echo/Collect")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, text := range []string{"a", "b"} {
+		if err := stream.Send(&echopb.EchoRequest{Text: text}); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if _, err := stream.CloseAndReceive(); err != nil {
+		t.Fatalf("%s", err)
+	}
+	_, err = sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, "/echo.v1.Echo/Missing",
+		sidecar.NewRequest(&echopb.EchoRequest{}))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	type entry struct {
+		Level            string `json:"level"`
+		Method           string `json:"method"`
+		Duration         *int64 `json:"duration"`
+		MessagesReceived int    `json:"messages_received"`
+		BytesReceived    int    `json:"bytes_received"`
+		MessagesSent     int    `json:"messages_sent"`
+		GrpcStatus       int    `json:"grpc_status"`
+		GrpcMessage      string `json:"grpc_message"`
+	}
+	var entries []entry
+	for line := range strings.Lines(log.String()) {
+		var e entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid log entry %q: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Level != "INFO" || e.Method != "/echo.v1.Echo/Collect" || e.Duration == nil ||
+		e.MessagesReceived != 2 || e.BytesReceived != 6 || e.MessagesSent != 1 || e.GrpcStatus != 0 || e.GrpcMessage != "" {
+		t.Errorf("unexpected log entry %+v", e)
+	}
+	if e := entries[1]; e.Level != "WARN" || e.Method != "unknown" || e.GrpcStatus != int(codes.Unimplemented) || e.GrpcMessage == "" {
+		t.Errorf("unexpected log entry %+v", e)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	listener, err := net.Listen("unix", "@echolimits")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Limits/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			return sidecar.NewResponse(req.Msg), nil
+		}))
+	mux.HandleFunc("/test.Limits/Slow", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			started <- struct{}{}
+			<-release
+			return sidecar.NewResponse(req.Msg), nil
+		}))
+	server := sidecar.NewServer(sidecar.HandleLimits(mux, sidecar.Limits{
+		Methods: map[string]sidecar.MethodLimits{
+			"/test.Limits/Get":  {Rate: 20, Burst: 2},
+			"/test.Limits/Slow": {MaxConcurrent: 1, Rate: 0.001, Burst: 2},
+		},
+		Default: sidecar.MethodLimits{Rate: 0.001, Burst: 1},
+	}))
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echolimits"})
+	msg := []byte("a")
+	// The concurrency limit rejects a second call while the first is in progress.
+	done := make(chan error)
+	go func() {
+		_, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Limits/Slow", sidecar.NewRequest(&msg))
+		done <- err
+	}()
+	<-started
+	_, err = sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Limits/Slow", sidecar.NewRequest(&msg))
+	if sidecar.ErrorCode(err) != int(codes.ResourceExhausted) {
+		t.Errorf("expected ResourceExhausted, got %v", err)
+	}
+	// post makes a call and returns its response, which holds the status of a rejected call.
+	post := func(method string) *http.Response {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, client.Host+method, bytes.NewReader([]byte{0, 0, 0, 0, 1, 'a'}))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		req.Header = client.Header.Clone()
+		resp, err := client.HttpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+	// Calls rejected by the concurrency limit also tell clients when to retry.
+	if pushback := post("/test.Limits/Slow").Header.Get("Grpc-Retry-Pushback-Ms"); pushback != "100" {
+		t.Errorf("expected a pushback of 100ms, got %q", pushback)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("%s", err)
+	}
+	// Calls rejected by the concurrency limit don't use rate tokens, so one is left.
+	go func() { <-started }()
+	if _, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Limits/Slow", sidecar.NewRequest(&msg)); err != nil {
+		t.Errorf("%s", err)
+	}
+	// The rate limit allows a burst of two calls and rejects the third with a retry delay.
+	for range 2 {
+		if _, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Limits/Get", sidecar.NewRequest(&msg)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	resp := post("/test.Limits/Get")
+	if status := resp.Header.Get("Grpc-Status"); status != strconv.Itoa(int(codes.ResourceExhausted)) {
+		t.Errorf("expected ResourceExhausted, got grpc-status %q", status)
+	}
+	if ms, err := strconv.Atoi(resp.Header.Get("Grpc-Retry-Pushback-Ms")); err != nil || ms <= 0 || ms > 50 {
+		t.Errorf("unexpected pushback %q", resp.Header.Get("Grpc-Retry-Pushback-Ms"))
+	}
+	details, err := base64.RawStdEncoding.DecodeString(resp.Header.Get("Grpc-Status-Details-Bin"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !bytes.Contains(details, []byte("type.googleapis.com/google.rpc.RetryInfo")) {
+		t.Errorf("expected a RetryInfo detail in %q", details)
+	}
+	// Paths without handlers are not limited, even with default limits.
+	for range 2 {
+		if status := post("/test.Limits/Missing").StatusCode; status != http.StatusNotFound {
+			t.Errorf("expected HTTP status 404 for a path without a handler, got %d", status)
+		}
+	}
+	// Clients that retry ResourceExhausted errors wait for the pushback and succeed.
+	config, err := sidecar.ParseServiceConfig([]byte(`{"methodConfig": [{"name": [{}], "retryPolicy": {
+		"maxAttempts": 2, "initialBackoff": "10s", "maxBackoff": "10s", "backoffMultiplier": 1,
+		"retryableStatusCodes": ["RESOURCE_EXHAUSTED"]}}]}`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	client = sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echolimits", ServiceConfig: config})
+	start := time.Now()
+	for range 3 {
+		if _, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Limits/Get", sidecar.NewRequest(&msg)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("retries took %s, expected them to follow the pushback", elapsed)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	// The server returns the authorization header of each call.
+	listener, err := net.Listen("unix", "@echocredentials")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Credentials/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			header, _ := sidecar.IncomingHeader(ctx)
+			b := []byte(header.Get("Authorization"))
+			return sidecar.NewResponse(&b), nil
+		}))
+	server := sidecar.NewServer(mux)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+	call := func(credentials sidecar.PerRPCCredentials) (string, error) {
+		client := sidecar.NewClient(sidecar.ClientOptions{Address: "unix:@echocredentials", Credentials: credentials})
+		msg := []byte{}
+		response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Credentials/Get", sidecar.NewRequest(&msg))
+		if err != nil {
+			return "", err
+		}
+		return string(*response.Msg), nil
+	}
+	expect := func(credentials sidecar.PerRPCCredentials, expected string) {
+		t.Helper()
+		if authorization, err := call(credentials); err != nil || authorization != expected {
+			t.Errorf("expected %q, got %q %v", expected, authorization, err)
+		}
+	}
+	expect(sidecar.StaticToken("abc"), "Bearer abc")
+	// Token files are read again when they change.
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("one\n"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	tokenFile := sidecar.TokenFile(path)
+	expect(tokenFile, "Bearer one")
+	if err := os.WriteFile(path, []byte("rotated\n"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	expect(tokenFile, "Bearer rotated")
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := call(tokenFile); sidecar.ErrorCode(err) != int(codes.Unavailable) {
+		t.Errorf("expected Unavailable for a missing token file, got %v", err)
+	}
+	// Client credentials are exchanged for tokens at a token endpoint.
+	var requests atomic.Int32
+	var expiresIn atomic.Int32
+	expiresIn.Store(3600)
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" || r.PostFormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		if r.PostFormValue("scope") != "echo.read echo.write" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_scope"}`))
+			return
+		}
+		n := requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, n, expiresIn.Load())
+	}))
+	defer tokenServer.Close()
+	credentials := &sidecar.ClientCredentials{
+		TokenURL:     tokenServer.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"echo.read", "echo.write"},
+	}
+	expect(credentials, "Bearer token-1")
+	expect(credentials, "Bearer token-1")
+	// Tokens that are about to expire are refreshed.
+	expiresIn.Store(5)
+	credentials = &sidecar.ClientCredentials{
+		TokenURL:     tokenServer.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"echo.read", "echo.write"},
+	}
+	expect(credentials, "Bearer token-2")
+	expect(credentials, "Bearer token-3")
+	_, err = call(&sidecar.ClientCredentials{TokenURL: tokenServer.URL, ClientID: "client", ClientSecret: "wrong"})
+	if sidecar.ErrorCode(err) != int(codes.Unauthenticated) || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+}
+
+func TestPeer(t *testing.T) {
+	// The server returns a description of the peer of each call.
+	mux := http.NewServeMux()
+	describe := func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+		p, ok := sidecar.PeerFromContext(ctx)
+		if !ok {
+			return nil, sidecar.NewError(errors.New("no peer"), codes.Internal)
+		}
+		b := fmt.Appendf(nil, "addr=%s tls=%t", p.Addr, p.TLS != nil)
+		if p.Unix != nil {
+			b = fmt.Appendf(b, " pid=%d uid=%d gid=%d", p.Unix.PID, p.Unix.UID, p.Unix.GID)
+		}
+		return sidecar.NewResponse(&b), nil
+	}
+	mux.HandleFunc("/test.Peer/Get", sidecar.HandleUnary(describe))
+	mux.HandleFunc("/test.Peer/Restricted", sidecar.HandleUnary(describe))
+	mux.HandleFunc("/test.Admin/Get", sidecar.HandleUnary(describe))
+	handler := sidecar.HandleAllowedUIDs(mux, map[string][]int{
+		"/test.Peer/Restricted": {os.Getuid() + 1},
+		"/test.Admin/":          {os.Getuid()},
+	})
+	unixListener, err := net.Listen("unix", "@echopeer")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(handler)
+	go func() { _ = server.Serve(unixListener) }()
+	go func() { _ = server.Serve(tcpListener) }()
+	defer server.Close()
+	call := func(address, method string) (string, error) {
+		client := sidecar.NewClient(sidecar.ClientOptions{Address: address})
+		msg := []byte{}
+		response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, method, sidecar.NewRequest(&msg))
+		if err != nil {
+			return "", err
+		}
+		return string(*response.Msg), nil
+	}
+	unixPeer := fmt.Sprintf("addr=@ tls=false pid=%d uid=%d gid=%d", os.Getpid(), os.Getuid(), os.Getgid())
+	for _, test := range []struct {
+		address  string
+		method   string
+		expected string
+		code     codes.Code
+	}{
+		{address: "unix:@echopeer", method: "/test.Peer/Get", expected: unixPeer},
+		{address: "unix:@echopeer", method: "/test.Admin/Get", expected: unixPeer},
+		{address: "unix:@echopeer", method: "/test.Peer/Restricted", code: codes.PermissionDenied},
+		{address: tcpListener.Addr().String(), method: "/test.Peer/Get", expected: "addr=127.0.0.1:"},
+		{address: tcpListener.Addr().String(), method: "/test.Admin/Get", code: codes.PermissionDenied},
+	} {
+		description, err := call(test.address, test.method)
+		if sidecar.ErrorCode(err) != int(test.code) {
+			t.Errorf("%s %s: expected %s, got %v", test.address, test.method, codes.Name(test.code), err)
+		}
+		if !strings.HasPrefix(description, test.expected) {
+			t.Errorf("%s %s: expected %q, got %q", test.address, test.method, test.expected, description)
+		}
+	}
+	// Connect calls of restricted methods are rejected too.
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	httpClient := &http.Client{Transport: &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", "@echopeer")
+		},
+	}}
+	resp, err := httpClient.Post("http://localhost/test.Peer/Restricted", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Connect call of /test.Peer/Restricted: expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestForwardedClientCert(t *testing.T) {
+	certs, err := sidecar.ParseForwardedClientCert(`By=spiffe://cluster.local/ns/a/sa/gateway;Hash=abc;URI=spiffe://cluster.local/ns/a/sa/web,` +
+		`By=spiffe://cluster.local/ns/b/sa/echo;Hash=468ed33be74e;Cert="-----BEGIN%20CERTIFICATE-----%0AMIIB%2B%3D%0A-----END%20CERTIFICATE-----%0A";` +
+		`Subject="CN=Test Client, O=\"Acme; Inc\"";URI=http://testclient.example.com;URI=spiffe://cluster.local/ns/b/sa/client;DNS=client.b.svc;DNS=client`)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(certs))
+	}
+	cert := certs[1]
+	if cert.By != "spiffe://cluster.local/ns/b/sa/echo" || cert.Hash != "468ed33be74e" ||
+		cert.Cert != "-----BEGIN CERTIFICATE-----\nMIIB+=\n-----END CERTIFICATE-----\n" ||
+		cert.Subject != `CN=Test Client, O="Acme; Inc"` ||
+		!slices.Equal(cert.DNS, []string{"client.b.svc", "client"}) ||
+		cert.SPIFFEID() != "spiffe://cluster.local/ns/b/sa/client" {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+	if certs[0].SPIFFEID() != "spiffe://cluster.local/ns/a/sa/web" {
+		t.Errorf("unexpected certificate %+v", certs[0])
+	}
+	// The server trusts proxies that connect to its unix socket as the same user.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Forwarded/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			p, _ := sidecar.PeerFromContext(ctx)
+			header, _ := sidecar.IncomingHeader(ctx)
+			b := fmt.Appendf(nil, "spiffe=%s forwarded=%t header=%t", p.SPIFFEID, p.ForwardedCert != nil, header.Get("X-Forwarded-Client-Cert") != "")
+			return sidecar.NewResponse(&b), nil
+		}))
+	handler := sidecar.HandleForwardedClientCert(mux, func(p *sidecar.Peer) bool {
+		return p.Unix != nil && p.Unix.UID == os.Getuid()
+	})
+	unixListener, err := net.Listen("unix", "@echoxfcc")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := sidecar.NewServer(handler)
+	go func() { _ = server.Serve(unixListener) }()
+	go func() { _ = server.Serve(tcpListener) }()
+	defer server.Close()
+	for _, test := range []struct {
+		address  string
+		xfcc     []string
+		expected string
+		code     codes.Code
+	}{
+		{address: "unix:@echoxfcc", xfcc: []string{"By=spiffe://td/proxy;URI=spiffe://td/caller"}, expected: "spiffe=spiffe://td/caller forwarded=true header=true"},
+		{address: "unix:@echoxfcc", expected: "spiffe= forwarded=false header=false"},
+		{address: "unix:@echoxfcc", xfcc: []string{"By=spiffe://td/gateway;URI=spiffe://td/caller", "By=spiffe://td/proxy;URI=spiffe://td/gateway"}, expected: "spiffe=spiffe://td/gateway forwarded=true header=true"},
+		{address: "unix:@echoxfcc", xfcc: []string{`Subject="unterminated`}, code: codes.Unauthenticated},
+		{address: tcpListener.Addr().String(), xfcc: []string{"URI=spiffe://td/spoofed"}, expected: "spiffe= forwarded=false header=false"},
+	} {
+		client := sidecar.NewClient(sidecar.ClientOptions{Address: test.address})
+		for _, value := range test.xfcc {
+			client.Header.Add("X-Forwarded-Client-Cert", value)
+		}
+		msg := []byte{}
+		response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Forwarded/Get", sidecar.NewRequest(&msg))
+		if sidecar.ErrorCode(err) != int(test.code) {
+			t.Errorf("%s %q: expected %s, got %v", test.address, test.xfcc, codes.Name(test.code), err)
+			continue
+		}
+		if err == nil && string(*response.Msg) != test.expected {
+			t.Errorf("%s %q: expected %q, got %q", test.address, test.xfcc, test.expected, *response.Msg)
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.Keepalive/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			p, _ := sidecar.PeerFromContext(ctx)
+			b := []byte(p.Addr)
+			return sidecar.NewResponse(&b), nil
+		}))
+	mux.HandleFunc("/test.Keepalive/Update", sidecar.HandleBidiStreaming(
+		func(ctx context.Context, stream *sidecar.BidiStream[[]byte, []byte]) error {
+			for msg, err := range stream.All() {
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	serve := func(options sidecar.ServerOptions, minPingInterval time.Duration) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		address := listener.Addr().String()
+		if minPingInterval > 0 {
+			listener = sidecar.EnforcePingInterval(listener, minPingInterval)
+		}
+		server := sidecar.NewServerWithOptions(mux, options)
+		go func() { _ = server.Serve(listener) }()
+		t.Cleanup(func() { _ = server.Close() })
+		return address
+	}
+	// exchange sends a message on a bidi stream and receives the reply.
+	exchange := func(stream *sidecar.BidiStreamForClient[[]byte, []byte]) error {
+		msg := []byte("a")
+		if err := stream.Send(&msg); err != nil {
+			return err
+		}
+		_, err := stream.Receive()
+		return err
+	}
+	t.Run("MaxConnectionAge", func(t *testing.T) {
+		address := serve(sidecar.ServerOptions{MaxConnectionAge: 100 * time.Millisecond, MaxConnectionAgeGrace: 100 * time.Millisecond}, 0)
+		client := sidecar.NewClient(sidecar.ClientOptions{Address: address})
+		get := func() string {
+			msg := []byte{}
+			response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.Keepalive/Get", sidecar.NewRequest(&msg))
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			return string(*response.Msg)
+		}
+		first := get()
+		time.Sleep(150 * time.Millisecond)
+		// This call is made on the old connection, which is then closed gracefully.
+		if second := get(); second != first {
+			t.Errorf("expected a call on the same connection, got %s and %s", first, second)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if third := get(); third == first {
+			t.Errorf("expected a call on a new connection, got %s", third)
+		}
+		// Streams that outlive the grace period are closed.
+		stream, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.Keepalive/Update")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer stream.Cancel()
+		if err := exchange(stream); err != nil {
+			t.Fatalf("%s", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if err := exchange(stream); sidecar.ErrorCode(err) != int(codes.Unavailable) {
+			t.Errorf("expected Unavailable after the grace period, got %v", err)
+		}
+	})
+	t.Run("MaxConnectionAgeWithoutGrace", func(t *testing.T) {
+		// Without a grace period, streams are not closed when connections reach their age.
+		address := serve(sidecar.ServerOptions{MaxConnectionAge: 100 * time.Millisecond}, 0)
+		client := sidecar.NewClient(sidecar.ClientOptions{Address: address})
+		stream, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.Keepalive/Update")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer stream.Cancel()
+		if err := exchange(stream); err != nil {
+			t.Fatalf("%s", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if err := exchange(stream); err != nil {
+			t.Errorf("expected the stream to outlive the connection age, got %v", err)
+		}
+	})
+	t.Run("EnforcePingInterval", func(t *testing.T) {
+		for _, minPingInterval := range []time.Duration{0, time.Second} {
+			address := serve(sidecar.ServerOptions{}, minPingInterval)
+			client := sidecar.NewClient(sidecar.ClientOptions{Address: address, PingInterval: 10 * time.Millisecond, PingTimeout: time.Second})
+			stream, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.Keepalive/Update")
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			if err := exchange(stream); err != nil {
+				t.Fatalf("%s", err)
+			}
+			// The idle client pings the server every 10ms.
+			time.Sleep(300 * time.Millisecond)
+			err = exchange(stream)
+			if minPingInterval == 0 && err != nil {
+				t.Errorf("expected pings to be allowed, got %v", err)
+			}
+			if minPingInterval > 0 && sidecar.ErrorCode(err) != int(codes.Unavailable) {
+				t.Errorf("expected Unavailable after too many pings, got %v", err)
+			}
+			stream.Cancel()
+		}
+		// Clients that ping too often are told why their connections are closed.
+		address := serve(sidecar.ServerOptions{}, time.Second)
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+			t.Fatalf("%s", err)
+		}
+		framer := http2.NewFramer(conn, conn)
+		if err := framer.WriteSettings(); err != nil {
+			t.Fatalf("%s", err)
+		}
+		for range 4 {
+			if err := framer.WritePing(false, [8]byte{}); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatalf("expected a GOAWAY frame, got %v", err)
+			}
+			if goAway, ok := frame.(*http2.GoAwayFrame); ok {
+				if goAway.ErrCode != http2.ErrCodeEnhanceYourCalm || string(goAway.DebugData()) != "too_many_pings" {
+					t.Errorf("expected ENHANCE_YOUR_CALM with too_many_pings, got %s with %q", goAway.ErrCode, goAway.DebugData())
+				}
+				break
+			}
+		}
+	})
+}
+
+// flowControlMux serves the methods of the flow control tests and benchmarks.
+// Expand sends a number of messages of the size of its request, and Update echoes its requests.
+func flowControlMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.FlowControl/Get", sidecar.HandleUnary(
+		func(ctx context.Context, req *sidecar.Request[[]byte]) (*sidecar.Response[[]byte], error) {
+			p, _ := sidecar.PeerFromContext(ctx)
+			b := []byte(p.Addr)
+			return sidecar.NewResponse(&b), nil
+		}))
+	mux.HandleFunc("/test.FlowControl/Expand", sidecar.HandleServerStreaming(
+		func(ctx context.Context, req *sidecar.Request[[]byte], stream *sidecar.ServerStream[[]byte]) error {
+			msg := make([]byte, len(*req.Msg))
+			for range flowControlMessages {
+				if err := stream.Send(&msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	mux.HandleFunc("/test.FlowControl/Update", sidecar.HandleBidiStreaming(
+		func(ctx context.Context, stream *sidecar.BidiStream[[]byte, []byte]) error {
+			for msg, err := range stream.All() {
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	return mux
+}
+
+// flowControlMessages is the number of messages in each stream of the flow control benchmarks.
+const flowControlMessages = 16
+
+// serveFlowControl starts a TCP server for the flow control tests and benchmarks and returns its address.
+func serveFlowControl(tb testing.TB, options sidecar.ServerOptions) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("%s", err)
+	}
+	server := sidecar.NewServerWithOptions(flowControlMux(), options)
+	go func() { _ = server.Serve(listener) }()
+	tb.Cleanup(func() { _ = server.Close() })
+	return listener.Addr().String()
+}
+
+func TestFlowControl(t *testing.T) {
+	t.Run("MaxConcurrentStreams", func(t *testing.T) {
+		for _, maxConcurrentStreams := range []int{0, 1} {
+			address := serveFlowControl(t, sidecar.ServerOptions{MaxConcurrentStreams: maxConcurrentStreams})
+			client := sidecar.NewClient(sidecar.ClientOptions{Address: address})
+			get := func() string {
+				msg := []byte{}
+				response, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.FlowControl/Get", sidecar.NewRequest(&msg))
+				if err != nil {
+					t.Fatalf("%s", err)
+				}
+				return string(*response.Msg)
+			}
+			first := get()
+			// Hold a stream open on the connection while making another call.
+			stream, err := sidecar.CallBidiStream[[]byte, []byte](t.Context(), client, "/test.FlowControl/Update")
+			if err != nil {
+				t.Fatalf("%s", err)
+			}
+			msg := []byte("a")
+			if err := stream.Send(&msg); err != nil {
+				t.Fatalf("%s", err)
+			}
+			if _, err := stream.Receive(); err != nil {
+				t.Fatalf("%s", err)
+			}
+			second := get()
+			stream.Cancel()
+			// Clients open another connection when a server's limit is reached.
+			if maxConcurrentStreams == 0 && second != first {
+				t.Errorf("expected calls on the same connection, got %s and %s", first, second)
+			}
+			if maxConcurrentStreams == 1 && second == first {
+				t.Errorf("expected calls on different connections, got %s", first)
+			}
+		}
+	})
+	t.Run("MaxHeaderListSize", func(t *testing.T) {
+		address := serveFlowControl(t, sidecar.ServerOptions{MaxHeaderListSize: 4096})
+		for _, size := range []int{100, 10000} {
+			client := sidecar.NewClient(sidecar.ClientOptions{
+				Address: address,
+				Headers: []string{"x-large: " + strings.Repeat("a", size)},
+			})
+			msg := []byte{}
+			_, err := sidecar.CallUnary[[]byte, []byte](t.Context(), client, "/test.FlowControl/Get", sidecar.NewRequest(&msg))
+			if size < 4096 && err != nil {
+				t.Errorf("expected a call with small headers to succeed, got %v", err)
+			}
+			if size > 4096 && err == nil {
+				t.Errorf("expected a call with large headers to fail")
+			}
+		}
+	})
+	t.Run("WindowSizes", func(t *testing.T) {
+		// Windows smaller than the messages require the receivers to update them.
+		options := sidecar.ServerOptions{InitialStreamWindowSize: 64 << 10, InitialConnWindowSize: 64 << 10, MaxFrameSize: 16 << 10}
+		address := serveFlowControl(t, options)
+		client := sidecar.NewClient(sidecar.ClientOptions{
+			Address:                 address,
+			InitialStreamWindowSize: 64 << 10,
+			InitialConnWindowSize:   64 << 10,
+			MaxFrameSize:            16 << 10,
+		})
+		if err := expand(t.Context(), client, 256<<10); err != nil {
+			t.Errorf("%s", err)
+		}
+		if err := update(t.Context(), client, 256<<10); err != nil {
+			t.Errorf("%s", err)
+		}
+	})
+}
+
+// expand makes an Expand call and receives its messages.
+func expand(ctx context.Context, client *sidecar.Client, size int) error {
+	msg := make([]byte, size)
+	stream, err := sidecar.CallServerStream[[]byte, []byte](ctx, client, "/test.FlowControl/Expand", sidecar.NewRequest(&msg))
+	if err != nil {
+		return err
+	}
+	n := 0
+	for msg, err := range stream.All() {
+		if err != nil {
+			return err
+		}
+		if len(*msg) != size {
+			return fmt.Errorf("expected %d bytes, got %d", size, len(*msg))
+		}
+		n++
+	}
+	if n != flowControlMessages {
+		return fmt.Errorf("expected %d messages, got %d", flowControlMessages, n)
+	}
+	return nil
+}
+
+// update makes an Update call that sends messages while receiving them.
+func update(ctx context.Context, client *sidecar.Client, size int) error {
+	stream, err := sidecar.CallBidiStream[[]byte, []byte](ctx, client, "/test.FlowControl/Update")
+	if err != nil {
+		return err
+	}
+	defer stream.Cancel()
+	errs := make(chan error, 1)
+	go func() {
+		msg := make([]byte, size)
+		for range flowControlMessages {
+			if err := stream.Send(&msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- stream.CloseRequest()
+	}()
+	n := 0
+	for msg, err := range stream.All() {
+		if err != nil {
+			return err
+		}
+		if len(*msg) != size {
+			return fmt.Errorf("expected %d bytes, got %d", size, len(*msg))
+		}
+		n++
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	if n != flowControlMessages {
+		return fmt.Errorf("expected %d messages, got %d", flowControlMessages, n)
+	}
+	return nil
+}
+
+// BenchmarkFlowControl compares the throughput of streams of large messages
+// with windows that are smaller than, equal to, and larger than the defaults.
+func BenchmarkFlowControl(b *testing.B) {
+	const size = 1 << 20
+	windows := []struct {
+		name                string
+		stream, conn, frame int
+	}{
+		{"Small", 64 << 10, 64 << 10, 16 << 10},
+		{"Default", 0, 0, 0},
+		{"Large", 4<<20 - 1, 4<<20 - 1, 1 << 20},
+	}
+	for _, method := range []struct {
+		name string
+		call func(context.Context, *sidecar.Client, int) error
+	}{
+		{"Expand", expand},
+		{"Update", update},
+	} {
+		for _, w := range windows {
+			b.Run(method.name+"/"+w.name, func(b *testing.B) {
+				address := serveFlowControl(b, sidecar.ServerOptions{
+					InitialStreamWindowSize: w.stream,
+					InitialConnWindowSize:   w.conn,
+					MaxFrameSize:            w.frame,
+				})
+				client := sidecar.NewClient(sidecar.ClientOptions{
+					Address:                 address,
+					InitialStreamWindowSize: w.stream,
+					InitialConnWindowSize:   w.conn,
+					MaxFrameSize:            w.frame,
+				})
+				b.SetBytes(size * flowControlMessages)
+				for b.Loop() {
+					if err := method.call(b.Context(), client, size); err != nil {
+						b.Fatalf("%s", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"serve", "--socket", "@echobench"})
+		err := serveCmd.Execute()
+		if err != nil {
+			log.Printf("failed to read output from buffer: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	for _, method := range []string{"get", "expand", "collect", "update"} {
+		cmd := commands.Cmd()
+		buffer := new(bytes.Buffer)
+		cmd.SetOut(buffer)
+		cmd.SetArgs([]string{"bench", method, "--address", "unix:@echobench", "-n", "100", "-c", "4", "--connections", "2", "--json"})
+		err := cmd.Execute()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		var summary track.Summary
+		if err := json.Unmarshal(buffer.Bytes(), &summary); err != nil {
+			t.Fatalf("failed to parse summary: %v", err)
+		}
+		if summary.Calls != 100 || len(summary.Errors) != 0 {
+			t.Errorf("%s: expected 100 calls without errors, got %d calls and errors %v", method, summary.Calls, summary.Errors)
+		}
+		if summary.P50 > summary.P99 || summary.P99 > summary.Max {
+			t.Errorf("%s: percentiles out of order: %+v", method, summary)
+		}
+	}
+	// Rates that don't give a usable interval between calls are rejected.
+	for _, rate := range []string{"-1", "2e9", "1e-12", "NaN"} {
+		cmd := commands.Cmd()
+		cmd.SetOut(new(bytes.Buffer))
+		cmd.SetErr(new(bytes.Buffer))
+		cmd.SetArgs([]string{"bench", "get", "--address", "unix:@echobench", "-n", "1", "--rate", rate})
+		if err := cmd.Execute(); err == nil {
+			t.Errorf("expected an error for rate %s", rate)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"serve", "--socket", "@echorecord"})
+		err := serveCmd.Execute()
+		if err != nil {
+			log.Printf("failed to read output from buffer: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	recording := filepath.Join(t.TempDir(), "calls.jsonl")
+	for _, method := range []string{"get", "expand", "collect", "update"} {
+		cmd := commands.Cmd()
+		cmd.SetOut(io.Discard)
+		cmd.SetArgs([]string{"call", method, "--address", "unix:@echorecord", "--record", recording})
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	replay := func(file string) (string, error) {
+		cmd := commands.Cmd()
+		buffer := new(bytes.Buffer)
+		cmd.SetOut(buffer)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs([]string{"replay", file, "--address", "unix:@echorecord"})
+		err := cmd.Execute()
+		return buffer.String(), err
+	}
+	out, err := replay(recording)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if out != "replayed 4 calls, 0 differed\n" {
+		t.Errorf("unexpected replay output %q", out)
+	}
+	// Change a recorded response and verify that the replay detects it.
+	b, err := os.ReadFile(recording)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var call sidecar.RecordedCall
+	lines := strings.SplitN(string(b), "\n", 2)
+	if err := json.Unmarshal([]byte(lines[0]), &call); err != nil {
+		t.Fatalf("%s", err)
+	}
+	call.Responses[0] = []byte("changed")
+	first, err := json.Marshal(call)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tampered := filepath.Join(t.TempDir(), "tampered.jsonl")
+	if err := os.WriteFile(tampered, append(append(first, '\n'), lines[1]...), 0o644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	out, err = replay(tampered)
+	if err == nil {
+		t.Errorf("expected replay of a changed recording to fail")
+	}
+	if !strings.HasPrefix(out, "DIFF /echo.v1.Echo/Get\n") {
+		t.Errorf("unexpected replay output %q", out)
+	}
+	// Credentials and authorization headers are not recorded.
+	var buffer bytes.Buffer
+	recorder := sidecar.NewRecorder(&buffer)
+	for _, credentials := range []sidecar.PerRPCCredentials{sidecar.StaticToken("secret-token"), apiKeyCredentials{}} {
+		client := recorder.Wrap(sidecar.NewClient(sidecar.ClientOptions{
+			Address:     "unix:@echorecord",
+			Headers:     []string{"x-custom: visible"},
+			Credentials: credentials,
+		}))
+		if _, err := sidecar.CallUnary[echopb.EchoRequest, echopb.EchoResponse](t.Context(), client, "/echo.v1.Echo/Get",
+			sidecar.NewRequest(&echopb.EchoRequest{Text: "hello"})); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if strings.Contains(buffer.String(), "secret") {
+		t.Errorf("expected no secrets in the recording, got %s", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "visible") {
+		t.Errorf("expected other headers in the recording, got %s", buffer.String())
+	}
+}
+
+// apiKeyCredentials sends an API key in a custom header.
+type apiKeyCredentials struct{}
+
+func (apiKeyCredentials) Header(ctx context.Context, method string) (http.Header, error) {
+	return http.Header{"X-Api-Key": {"secret-key"}}, nil
+}
+
+func TestMock(t *testing.T) {
+	dir := t.TempDir()
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(echopb.File_echo_v1_echo_proto)},
+	}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	descriptor := filepath.Join(dir, "echo.pb")
+	if err := os.WriteFile(descriptor, b, 0o644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	script := filepath.Join(dir, "script.yaml")
+	if err := os.WriteFile(script, []byte(mock_script), 0o644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	go func() {
+		serveCmd := commands.Cmd()
+		serveCmd.SetArgs([]string{"mock", "--socket", "@echomock", "--descriptor", descriptor, "--script", script})
+		err := serveCmd.Execute()
+		if err != nil {
+			log.Printf("failed to read output from buffer: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tests := []struct {
+		Args     []string
+		Expected string
+		Error    string
+	}{
+		{
+			Args:  []string{"call", "get"},
+			Error: "no such echo",
+		},
+		{
+			Args:     []string{"call", "expand"},
+			Expected: expected_mock_expand,
+		},
+		{
+			Args:     []string{"call", "collect"},
+			Expected: "{}\n",
+		},
+		{
+			Args:     []string{"call", "update", "-n", "3"},
+			Expected: expected_mock_update,
+			Error:    "stream stopped",
+		},
+	}
+	for _, test := range tests {
+		cmd := commands.Cmd()
+		buffer := new(bytes.Buffer)
+		cmd.SetOut(buffer)
+		cmd.SetErr(io.Discard)
+		cmd.SilenceUsage = true
+		cmd.SetArgs(append(test.Args, "--address", "unix:@echomock"))
+		err := cmd.Execute()
+		if test.Error != "" {
+			if err == nil || err.Error() != test.Error {
+				t.Errorf("expected error %q, got %v", test.Error, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s", err)
+		}
+		if buffer.String() != test.Expected {
+			t.Errorf("expected %q, got %q", test.Expected, buffer.String())
+		}
+	}
+	// Scripted errors must have codes other than OK.
+	for _, code := range []string{"OK", "0", "17", "Bogus"} {
+		invalid := filepath.Join(dir, "invalid.yaml")
+		content := "methods:\n  /echo.v1.Echo/Get:\n    error:\n      code: \"" + code + "\"\n"
+		if err := os.WriteFile(invalid, []byte(content), 0o644); err != nil {
+			t.Fatalf("%s", err)
+		}
+		cmd := commands.Cmd()
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs([]string{"mock", "--socket", "@echomockinvalid", "--descriptor", descriptor, "--script", invalid})
+		if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "invalid error code") {
+			t.Errorf("expected an invalid error code error for %s, got %v", code, err)
+		}
+	}
+}
+
 func test_service(t *testing.T, serverArgs, clientArgs []string) {
 	go func() {
 		serveCmd := commands.Cmd()
@@ -37,6 +2316,7 @@ func test_service(t *testing.T, serverArgs, clientArgs []string) {
 	time.Sleep(10 * time.Millisecond)
 	tests := []struct {
 		Args     []string
+		Input    string
 		Expected string
 	}{
 		{
@@ -55,11 +2335,26 @@ func test_service(t *testing.T, serverArgs, clientArgs []string) {
 			Args:     []string{"call", "update"},
 			Expected: expected_update,
 		},
+		{
+			Args:     []string{"call", "collect", "--input", "-"},
+			Input:    expected_input,
+			Expected: expected_collect_input,
+		},
+		{
+			Args:     []string{"call", "update", "--input", "-"},
+			Input:    expected_input,
+			Expected: expected_update_input,
+		},
+		{
+			Args:     []string{"call", "update", "-n", "2"},
+			Expected: expected_update_2,
+		},
 	}
 	for _, test := range tests {
 		cmd := commands.Cmd()
 		buffer := new(bytes.Buffer)
 		cmd.SetOut(buffer)
+		cmd.SetIn(strings.NewReader(test.Input))
 		cmd.SetArgs(append(test.Args, clientArgs...))
 		err := cmd.Execute()
 		if err != nil {
@@ -90,3 +2385,45 @@ const expected_update = `{"text":"Go echo update: hello"}
 {"text":"Go echo update: hello"}
 {"text":"Go echo update: hello"}
 `
+
+const expected_input = `{"text":"one"}
+
+{"text":"two"}
+{"text":"three"}
+`
+const expected_collect_input = `{"text":"Go echo collect: one two three"}
+`
+const expected_update_input = `{"text":"Go echo update: one"}
+{"text":"Go echo update: two"}
+{"text":"Go echo update: three"}
+`
+const expected_update_2 = `{"text":"Go echo update: hello"}
+{"text":"Go echo update: hello"}
+`
+
+const mock_script = `methods:
+  /echo.v1.Echo/Get:
+    delay: 5ms
+    error:
+      code: NotFound
+      message: no such echo
+  echo.v1.Echo/Expand:
+    responses:
+      - message: {text: first}
+      - message: {text: second}
+        delay: 5ms
+  /echo.v1.Echo/Update:
+    responses:
+      - message: {text: ping}
+      - message: {text: pong}
+    error:
+      code: ABORTED
+      message: stream stopped
+`
+const expected_mock_expand = `{"text":"first"}
+{"text":"second"}
+`
+const expected_mock_update = `{"text":"ping"}
+{"text":"pong"}
+{"text":"ping"}
+`
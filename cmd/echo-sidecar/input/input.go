@@ -0,0 +1,52 @@
+// Package input reads request messages for streaming calls.
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxLineSize is the largest JSON-encoded message that can be read.
+const maxLineSize = 4 * 1024 * 1024
+
+// Open opens a named input file, or the command's standard input if the name is "-".
+func Open(cmd *cobra.Command, name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(cmd.InOrStdin()), nil
+	}
+	return os.Open(name)
+}
+
+// ForEach reads newline-delimited JSON messages from a reader and calls fn
+// with each one as soon as it is read. Blank lines are ignored.
+func ForEach[T any](r io.Reader, fn func(*T) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		msg := new(T)
+		message, ok := any(msg).(proto.Message)
+		if !ok {
+			return fmt.Errorf("unsupported message type: %T", msg)
+		}
+		if err := protojson.Unmarshal(b, message); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,22 @@
+// Package recording records the calls that commands make.
+package recording
+
+import (
+	"os"
+
+	"github.com/agentio/sidecar"
+)
+
+// Wrap returns a client that appends a JSONL recording of its calls to a named
+// file, or the client itself if the name is empty. The returned function closes
+// the file when the calls are done.
+func Wrap(client *sidecar.Client, name string) (*sidecar.Client, func(), error) {
+	if name == "" {
+		return client, func() {}, nil
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sidecar.NewRecorder(f).Wrap(client), func() { _ = f.Close() }, nil
+}
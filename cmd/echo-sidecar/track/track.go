@@ -2,13 +2,117 @@
 package track
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
+	"maps"
+	"slices"
+	"sync"
 	"time"
+
+	"github.com/agentio/sidecar"
+	"github.com/agentio/sidecar/codes"
 )
 
 func Measure(start time.Time, name string, count int, out io.Writer) {
 	if count > 1 {
 		elapsed := time.Since(start)
-		_, _ = out.Write([]byte(time.Duration(elapsed / time.Duration(count)).String()))
+		_, _ = fmt.Fprintf(out, "%s\n", time.Duration(elapsed/time.Duration(count)))
+	}
+}
+
+// Recorder collects the latencies and results of a series of calls.
+// It is safe for concurrent use.
+type Recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    map[codes.Code]int
+}
+
+// NewRecorder creates an empty recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{errors: make(map[codes.Code]int)}
+}
+
+// Record records the duration and result of a single call.
+func (r *Recorder) Record(d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies = append(r.latencies, d)
+	if err != nil {
+		r.errors[codes.Code(sidecar.ErrorCode(err))]++
+	}
+}
+
+// Summary describes the results of a series of calls.
+type Summary struct {
+	Method     string         `json:"method"`
+	Calls      int            `json:"calls"`
+	Errors     map[string]int `json:"errors"`
+	Elapsed    time.Duration  `json:"elapsed_ns"`
+	Throughput float64        `json:"throughput"`
+	Mean       time.Duration  `json:"mean_ns"`
+	P50        time.Duration  `json:"p50_ns"`
+	P90        time.Duration  `json:"p90_ns"`
+	P99        time.Duration  `json:"p99_ns"`
+	Max        time.Duration  `json:"max_ns"`
+}
+
+// Summary computes a summary of the calls recorded so far.
+func (r *Recorder) Summary(method string, elapsed time.Duration) *Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	latencies := slices.Clone(r.latencies)
+	slices.Sort(latencies)
+	s := &Summary{
+		Method:  method,
+		Calls:   len(latencies),
+		Errors:  make(map[string]int),
+		Elapsed: elapsed,
 	}
+	for code, count := range r.errors {
+		s.Errors[codes.Name(code)] += count
+	}
+	if elapsed > 0 {
+		s.Throughput = float64(s.Calls) / elapsed.Seconds()
+	}
+	if len(latencies) == 0 {
+		return s
+	}
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	s.Mean = total / time.Duration(len(latencies))
+	s.P50 = percentile(latencies, 50)
+	s.P90 = percentile(latencies, 90)
+	s.P99 = percentile(latencies, 99)
+	s.Max = latencies[len(latencies)-1]
+	return s
+}
+
+// percentile returns the nearest-rank percentile of a sorted slice.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// WriteText writes a human-readable form of the summary.
+func (s *Summary) WriteText(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "method:     %s\n", s.Method)
+	_, _ = fmt.Fprintf(out, "calls:      %d\n", s.Calls)
+	_, _ = fmt.Fprintf(out, "elapsed:    %s\n", s.Elapsed)
+	_, _ = fmt.Fprintf(out, "throughput: %.1f calls/s\n", s.Throughput)
+	_, _ = fmt.Fprintf(out, "latency:    mean=%s p50=%s p90=%s p99=%s max=%s\n", s.Mean, s.P50, s.P90, s.P99, s.Max)
+	for _, name := range slices.Sorted(maps.Keys(s.Errors)) {
+		_, _ = fmt.Fprintf(out, "errors:     %s=%d\n", name, s.Errors[name])
+	}
+}
+
+// WriteJSON writes the summary as a single line of JSON.
+func (s *Summary) WriteJSON(out io.Writer) error {
+	return json.NewEncoder(out).Encode(s)
 }
@@ -0,0 +1,169 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/agentio/sidecar/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals and unmarshals messages.
+//
+// Codecs are selected by the subtype of the gRPC content type, which is the
+// codec name: "application/grpc+json" uses the codec named "json".
+// Requests without a subtype use the "proto" codec.
+// All codecs should send and receive *[]byte values as raw message bodies.
+type Codec interface {
+	Name() string
+	Marshal(value any) ([]byte, error)
+	Unmarshal(b []byte, value any) error
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{
+		"proto": ProtoCodec{},
+		"json":  JSONCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available to servers and clients.
+// It panics if a codec with the same name is already registered.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	if _, ok := codecs[codec.Name()]; ok {
+		panic("sidecar: RegisterCodec called twice for codec " + codec.Name())
+	}
+	codecs[codec.Name()] = codec
+}
+
+// CodecForName returns the registered codec with the specified name.
+func CodecForName(name string) (Codec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// ProtoCodec encodes proto.Message values in the protobuf binary format.
+// It is the default codec.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Name() string { return "proto" }
+
+func (ProtoCodec) Marshal(value any) ([]byte, error) {
+	// A []byte value is sent as the raw message body.
+	if b, ok := value.(*[]byte); ok {
+		return *b, nil
+	}
+	if message, ok := value.(proto.Message); ok {
+		return proto.Marshal(message)
+	}
+	return nil, NewError(fmt.Errorf("unsupported message type: %T", value), codes.InvalidArgument)
+}
+
+func (ProtoCodec) Unmarshal(b []byte, value any) error {
+	// A []byte value is set to the raw message body.
+	if byteSlice, ok := value.(*[]byte); ok {
+		*byteSlice = b
+		return nil
+	}
+	if message, ok := value.(proto.Message); ok {
+		err := proto.Unmarshal(b, message)
+		if err != nil {
+			return NewError(fmt.Errorf("failed to unmarshal %T, %s", message, err), codes.InvalidArgument)
+		}
+		return nil
+	}
+	return NewError(fmt.Errorf("unsupported message type: %T", value), codes.InvalidArgument)
+}
+
+// ProtoJSONCodec encodes proto.Message values in the protobuf JSON format.
+// It has the same name as JSONCodec, which replaces it as the registered "json"
+// codec and encodes proto.Message values in the same way, so servers decode the
+// messages of clients that use either one. ProtoJSONCodec can be set in
+// ClientOptions to reject values that aren't protobuf messages, but RegisterCodec
+// panics if it is registered.
+type ProtoJSONCodec struct{}
+
+func (ProtoJSONCodec) Name() string { return "json" }
+
+func (ProtoJSONCodec) Marshal(value any) ([]byte, error) {
+	if b, ok := value.(*[]byte); ok {
+		return *b, nil
+	}
+	if message, ok := value.(proto.Message); ok {
+		return protojson.Marshal(message)
+	}
+	return nil, NewError(fmt.Errorf("unsupported message type: %T", value), codes.InvalidArgument)
+}
+
+func (ProtoJSONCodec) Unmarshal(b []byte, value any) error {
+	if byteSlice, ok := value.(*[]byte); ok {
+		*byteSlice = b
+		return nil
+	}
+	if message, ok := value.(proto.Message); ok {
+		err := protojson.Unmarshal(b, message)
+		if err != nil {
+			return NewError(fmt.Errorf("failed to unmarshal %T, %s", message, err), codes.InvalidArgument)
+		}
+		return nil
+	}
+	return NewError(fmt.Errorf("unsupported message type: %T", value), codes.InvalidArgument)
+}
+
+// JSONCodec encodes proto.Message values in the protobuf JSON format and
+// all other values with encoding/json, so that services can be written
+// with plain Go types. It replaces ProtoJSONCodec as the registered "json"
+// codec, so requests with the "json" subtype are always decoded with JSONCodec.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) Marshal(value any) ([]byte, error) {
+	switch value.(type) {
+	case *[]byte, proto.Message:
+		return ProtoJSONCodec{}.Marshal(value)
+	}
+	return json.Marshal(value)
+}
+
+func (JSONCodec) Unmarshal(b []byte, value any) error {
+	switch value.(type) {
+	case *[]byte, proto.Message:
+		return ProtoJSONCodec{}.Unmarshal(b, value)
+	}
+	err := json.Unmarshal(b, value)
+	if err != nil {
+		return NewError(fmt.Errorf("failed to unmarshal %T, %s", value, err), codes.InvalidArgument)
+	}
+	return nil
+}
+
+// codecForContentType selects a registered codec from the subtype of a gRPC content type.
+func codecForContentType(contentType string) (Codec, error) {
+	name := "proto"
+	if _, subtype, ok := strings.Cut(contentType, "+"); ok {
+		subtype, _, _ = strings.Cut(subtype, ";")
+		name = strings.TrimSpace(subtype)
+	}
+	codec, ok := CodecForName(name)
+	if !ok {
+		return nil, NewError(fmt.Errorf("no codec registered for content-subtype %q", name), codes.Internal)
+	}
+	return codec, nil
+}
+
+// contentTypeForCodec returns the gRPC content type to use with a codec.
+func contentTypeForCodec(codec Codec) string {
+	if codec.Name() == "proto" {
+		return grpcContentType
+	}
+	return grpcContentType + "+" + codec.Name()
+}
@@ -1,5 +1,10 @@
 package codes
 
+import (
+	"strconv"
+	"strings"
+)
+
 func Name(code Code) string {
 	switch code {
 	case OK:
@@ -40,3 +45,36 @@ func Name(code Code) string {
 		return "Unknown"
 	}
 }
+
+// ForName returns the code with the specified name.
+// The second return value is false if no code has that name.
+func ForName(name string) (Code, bool) {
+	for code := OK; code < MaxCode; code++ {
+		if Name(code) == name {
+			return code, true
+		}
+	}
+	return Unknown, false
+}
+
+// Parse returns the code written as a name (e.g. "Unavailable"), as a name in
+// the upper snake case of gRPC service configs (e.g. "UNAVAILABLE"), or as a number.
+// The second return value is false if the string is not a code.
+func Parse(s string) (Code, bool) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n >= MaxCode {
+			return Unknown, false
+		}
+		return Code(n), true
+	}
+	if code, ok := ForName(s); ok {
+		return code, true
+	}
+	var b strings.Builder
+	for word := range strings.SplitSeq(strings.ToLower(s), "_") {
+		if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return ForName(b.String())
+}
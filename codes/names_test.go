@@ -0,0 +1,36 @@
+package codes
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		code Code
+		ok   bool
+	}{
+		{s: "Unavailable", code: Unavailable, ok: true},
+		{s: "UNAVAILABLE", code: Unavailable, ok: true},
+		{s: "DeadlineExceeded", code: DeadlineExceeded, ok: true},
+		{s: "DEADLINE_EXCEEDED", code: DeadlineExceeded, ok: true},
+		{s: "OK", code: OK, ok: true},
+		{s: "0", code: OK, ok: true},
+		{s: "14", code: Unavailable, ok: true},
+		{s: "16", code: Unauthenticated, ok: true},
+		{s: ""},
+		{s: "17"},
+		{s: "-1"},
+		{s: "1.5"},
+		{s: "Bogus"},
+		{s: "NOT_A_CODE"},
+	} {
+		code, ok := Parse(test.s)
+		if ok != test.ok || (ok && code != test.code) {
+			t.Errorf("Parse(%q): expected %s %t, got %s %t", test.s, Name(test.code), test.ok, Name(code), ok)
+		}
+	}
+	for code := OK; code < MaxCode; code++ {
+		if parsed, ok := Parse(Name(code)); !ok || parsed != code {
+			t.Errorf("Parse(%q): expected %s, got %s %t", Name(code), Name(code), Name(parsed), ok)
+		}
+	}
+}
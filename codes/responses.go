@@ -5,8 +5,14 @@ import (
 	"strconv"
 )
 
+// CodeFromResponse returns the code in the Grpc-Status trailer of a response or,
+// for trailers-only responses, in its header. Trailers are only available after
+// the response body has been read.
 func CodeFromResponse(resp *http.Response) Code {
-	grpcstatus := resp.Header.Get("Grpc-Status")
+	grpcstatus := resp.Trailer.Get("Grpc-Status")
+	if grpcstatus == "" {
+		grpcstatus = resp.Header.Get("Grpc-Status")
+	}
 	if grpcstatus != "" {
 		code, err := strconv.Atoi(grpcstatus)
 		if err == nil {
@@ -17,3 +23,22 @@ func CodeFromResponse(resp *http.Response) Code {
 	}
 	return OK
 }
+
+// CodeForHTTPStatus returns the code that corresponds to the HTTP status of a
+// response without a Grpc-Status, following the gRPC HTTP-to-gRPC status mapping.
+func CodeForHTTPStatus(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	default:
+		return Unknown
+	}
+}
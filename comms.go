@@ -2,6 +2,7 @@ package sidecar
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,15 +11,17 @@ import (
 
 	"github.com/agentio/sidecar/codes"
 	"golang.org/x/net/http2"
-
-	"google.golang.org/protobuf/proto"
 )
 
 // Send writes a message to a writer with gRPC framing.
 //
 // The value must be a proto.Message; if not, an error is returned.
 func Send(w io.Writer, value any) error {
-	buf, err := serialize(value)
+	return send(w, value, ProtoCodec{})
+}
+
+func send(w io.Writer, value any, codec Codec) error {
+	buf, err := serialize(value, codec)
 	if err != nil {
 		return err
 	}
@@ -36,43 +39,57 @@ func Send(w io.Writer, value any) error {
 //
 // The value must be a proto.Message; if not, an error is returned.
 func Receive(reader io.Reader, value any) error {
+	return receive(reader, value, ProtoCodec{})
+}
+
+func receive(reader io.Reader, value any, codec Codec) error {
 	b, err := unframe(reader)
-	if errors.Is(err, io.EOF) {
+	var e *Error
+	if errors.Is(err, io.EOF) || errors.As(err, &e) {
 		return err
 	} else if err != nil {
 		return NewError(err, codes.InvalidArgument)
 	}
-	// A []byte value is set to the raw message body.
-	if byteSlice, ok := value.(*[]byte); ok {
-		*byteSlice = b
-		return nil
-	}
-	// A proto.Message value is set to the unmarshalled message.
-	if message, ok := value.(proto.Message); ok {
-		err = proto.Unmarshal(b, message)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal %T, %s", message, err)
-		}
-		return nil
+	return codec.Unmarshal(b, value)
+}
+
+// receiveResponse reads a response message on a client,
+// where read failures are reported with responseError.
+func receiveResponse(ctx context.Context, reader io.Reader, value any, codec Codec) error {
+	b, err := unframe(reader)
+	if errors.Is(err, io.EOF) {
+		return err
+	} else if err != nil {
+		return responseError(ctx, err)
 	}
-	return NewError(fmt.Errorf("unsupported message type: %T", value), codes.InvalidArgument)
+	return codec.Unmarshal(b, value)
 }
 
-func serialize(value any) (*bytes.Buffer, error) {
-	// A []byte value is just wrapped in gRPC framing.
-	if b, ok := value.(*[]byte); ok {
-		return frame(*b), nil
+// drainResponse reads the rest of a response body so that its trailers are available.
+func drainResponse(ctx context.Context, reader io.Reader) error {
+	_, err := io.ReadAll(reader)
+	if err != nil {
+		return responseError(ctx, err)
+	}
+	return nil
+}
 
+// responseError reports a failure to read a response. Responses that end in
+// the middle of a message violate the protocol, so they are reported as Internal
+// errors, which are not retried. Other failures are reported as transport errors.
+func responseError(ctx context.Context, err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return NewError(fmt.Errorf("truncated response message: %w", err), codes.Internal)
 	}
-	// A proto.Message value is marshalled and framed.
-	if message, ok := value.(proto.Message); ok {
-		b, err := proto.Marshal(message)
-		if err != nil {
-			return nil, err
-		}
-		return frame(b), nil
+	return transportError(ctx, err)
+}
+
+func serialize(value any, codec Codec) (*bytes.Buffer, error) {
+	b, err := codec.Marshal(value)
+	if err != nil {
+		return nil, err
 	}
-	return nil, NewError(fmt.Errorf("unsupported message type: %T", value), codes.InvalidArgument)
+	return frame(b), nil
 }
 
 func frame(b []byte) *bytes.Buffer {
@@ -88,7 +105,7 @@ func frame(b []byte) *bytes.Buffer {
 func unframe(reader io.Reader) ([]byte, error) {
 	// the first byte indicates compression, the next 4 are for message length
 	prefix := make([]byte, 5)
-	n, err := reader.Read(prefix)
+	_, err := io.ReadFull(reader, prefix)
 	if err != nil {
 		var streamErr http2.StreamError
 		if errors.As(err, &streamErr) {
@@ -98,16 +115,13 @@ func unframe(reader io.Reader) ([]byte, error) {
 		}
 		return nil, err
 	}
-	if n != 5 {
-		return nil, io.EOF
-	}
 	compression := prefix[0]
 	if compression != 0 {
-		return nil, fmt.Errorf("unsupported compression byte %d", compression)
+		return nil, NewError(fmt.Errorf("unsupported compression byte %d", compression), codes.Unimplemented)
 	}
 	length := binary.BigEndian.Uint32(prefix[1:5])
 	b := make([]byte, length)
-	n, err = io.ReadFull(reader, b)
+	n, err := io.ReadFull(reader, b)
 	if err != nil {
 		return nil, err
 	}
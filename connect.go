@@ -0,0 +1,275 @@
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+const (
+	connectUnaryPrefix     = "application/"
+	connectStreamingPrefix = "application/connect+"
+
+	// endStreamFlag marks a Connect frame that ends a response stream.
+	endStreamFlag = 0x02
+)
+
+// HandleConnect wraps a handler so that it also serves the Connect protocol.
+//
+// Unary requests (POST with application/proto or application/json bodies) and
+// streaming requests (application/connect+proto or application/connect+json)
+// are translated into gRPC requests for the wrapped handler, and its responses
+// are translated back, with errors written in the Connect JSON format.
+// All other requests are passed to the handler unchanged.
+func HandleConnect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+		mediaType = strings.TrimSpace(mediaType)
+		var subtype string
+		var streaming bool
+		switch mediaType {
+		case "application/proto", "application/json":
+			subtype = strings.TrimPrefix(mediaType, connectUnaryPrefix)
+		case "application/connect+proto", "application/connect+json":
+			subtype = strings.TrimPrefix(mediaType, connectStreamingPrefix)
+			streaming = true
+		default:
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if timeout := r.Header.Get("Connect-Timeout-Ms"); timeout != "" {
+			if ms, err := strconv.ParseInt(timeout, 10, 64); err == nil {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+				defer cancel()
+			}
+		}
+		r = withTranslated(r.Clone(ctx))
+		r.Header.Set("Content-Type", grpcContentType+"+"+subtype)
+		if streaming {
+			serveConnectStreaming(handler, w, r, subtype)
+		} else {
+			serveConnectUnary(handler, w, r, subtype)
+		}
+	})
+}
+
+func serveConnectUnary(handler http.Handler, w http.ResponseWriter, r *http.Request, subtype string) {
+	if r.Method != http.MethodPost {
+		writeConnectError(w, codes.Unimplemented, "unsupported method "+r.Method)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeConnectError(w, codes.InvalidArgument, err.Error())
+		return
+	}
+	framed := frame(body)
+	r.Body = io.NopCloser(framed)
+	r.ContentLength = int64(framed.Len())
+	rec := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(rec, r)
+	trailer := takeTrailers(rec.header)
+	status, message := trailer.Get("Grpc-Status"), trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = rec.header.Get("Grpc-Status"), rec.header.Get("Grpc-Message")
+	}
+	if status == "" && rec.status != http.StatusOK {
+		// The request did not reach a gRPC handler.
+		code := codes.Unknown
+		if rec.status == http.StatusNotFound {
+			code = codes.Unimplemented
+		}
+		writeConnectError(w, code, strings.TrimSpace(rec.body.String()))
+		return
+	}
+	if code, _ := strconv.Atoi(status); code != int(codes.OK) {
+		writeConnectError(w, codes.Code(code), message)
+		return
+	}
+	msg, err := unframe(&rec.body)
+	if err != nil {
+		writeConnectError(w, codes.Internal, "handler did not return a message")
+		return
+	}
+	header := w.Header()
+	for key, values := range rec.header {
+		switch key {
+		case "Content-Type", "Grpc-Status", "Grpc-Message", "Trailer":
+		default:
+			header[key] = values
+		}
+	}
+	for key, values := range trailer {
+		if !strings.HasPrefix(key, "Grpc-") {
+			header["Trailer-"+key] = values
+		}
+	}
+	header.Set("Content-Type", connectUnaryPrefix+subtype)
+	header.Set("Content-Length", strconv.Itoa(len(msg)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(msg)
+}
+
+func serveConnectStreaming(handler http.Handler, w http.ResponseWriter, r *http.Request, subtype string) {
+	if r.ProtoMajor == 1 {
+		// Allow streaming handlers to read requests after writing responses.
+		_ = http.NewResponseController(w).EnableFullDuplex()
+	}
+	cw := &connectResponseWriter{ResponseWriter: w, subtype: subtype}
+	handler.ServeHTTP(cw, r)
+	cw.finish()
+}
+
+// connectError is the JSON form of a Connect error.
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// connectEndStream is the JSON body of the frame that ends a Connect stream.
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+func writeConnectError(w http.ResponseWriter, code codes.Code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(connectHTTPStatus(code))
+	_ = json.NewEncoder(w).Encode(&connectError{Code: connectCodeName(code), Message: message})
+}
+
+// connectResponseWriter translates gRPC streaming responses into Connect streaming responses.
+type connectResponseWriter struct {
+	http.ResponseWriter
+	subtype     string
+	status      int
+	wroteHeader bool
+}
+
+func (w *connectResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+		header := w.Header()
+		if strings.HasPrefix(header.Get("Content-Type"), grpcContentType) {
+			header.Set("Content-Type", connectStreamingPrefix+w.subtype)
+		}
+		header.Del("Trailer")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *connectResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *connectResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *connectResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish moves any trailers set by the handler into an end-of-stream frame.
+func (w *connectResponseWriter) finish() {
+	header := w.Header()
+	trailer := takeTrailers(header)
+	if w.wroteHeader && w.status != http.StatusOK {
+		return
+	}
+	status, message := trailer.Get("Grpc-Status"), trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = header.Get("Grpc-Status"), header.Get("Grpc-Message")
+	}
+	var end connectEndStream
+	if code, _ := strconv.Atoi(status); code != int(codes.OK) {
+		end.Error = &connectError{Code: connectCodeName(codes.Code(code)), Message: message}
+	}
+	for key, values := range trailer {
+		if !strings.HasPrefix(key, "Grpc-") {
+			if end.Metadata == nil {
+				end.Metadata = make(map[string][]string)
+			}
+			end.Metadata[key] = values
+		}
+	}
+	b, _ := json.Marshal(&end)
+	f := frame(b)
+	f.Bytes()[0] = endStreamFlag
+	_, _ = w.Write(f.Bytes())
+	w.Flush()
+}
+
+// bufferedResponseWriter holds a complete response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header { return w.header }
+
+func (w *bufferedResponseWriter) WriteHeader(code int) { w.status = code }
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+
+func (w *bufferedResponseWriter) Flush() {}
+
+// connectCodeName returns the Connect name of a code, e.g. "invalid_argument".
+func connectCodeName(code codes.Code) string {
+	name := codes.Name(code)
+	var b strings.Builder
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// connectHTTPStatus returns the HTTP status that Connect uses for unary errors with a code.
+func connectHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
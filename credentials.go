@@ -0,0 +1,181 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// PerRPCCredentials provides headers, such as authorization headers, for calls.
+//
+// Clients consult their credentials for every attempt of every call, so
+// implementations should cache their headers and be safe for concurrent use.
+// Calls fail with the errors that credentials return, which are reported
+// with the Unavailable code unless they are Errors with other codes.
+type PerRPCCredentials interface {
+	Header(ctx context.Context, method string) (http.Header, error)
+}
+
+// bearerHeader returns an authorization header for a bearer token.
+func bearerHeader(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// StaticToken returns credentials that send the same bearer token with every call.
+func StaticToken(token string) PerRPCCredentials {
+	return staticToken(token)
+}
+
+type staticToken string
+
+func (t staticToken) Header(ctx context.Context, method string) (http.Header, error) {
+	return bearerHeader(string(t)), nil
+}
+
+// TokenFile returns credentials that send a bearer token that is read from a file,
+// such as a Kubernetes projected service account token. The file is read again
+// whenever its modification time or size changes.
+func TokenFile(path string) PerRPCCredentials {
+	return &tokenFile{path: path}
+}
+
+type tokenFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+func (f *tokenFile) Header(ctx context.Context, method string) (http.Header, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.token == "" || !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return nil, fmt.Errorf("token file %s is empty", f.path)
+		}
+		f.token, f.modTime, f.size = token, info.ModTime(), info.Size()
+	}
+	return bearerHeader(f.token), nil
+}
+
+// tokenExpiryDelta is the time before their expiry at which tokens are refreshed.
+const tokenExpiryDelta = 10 * time.Second
+
+// ClientCredentials are credentials that send bearer tokens that are
+// obtained with the OAuth2 client credentials flow (RFC 6749, section 4.4).
+// Tokens are cached until shortly before they expire. ClientCredentials
+// must not be copied after first use.
+type ClientCredentials struct {
+	// TokenURL is the token endpoint of the authorization server.
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// HTTPClient is used to call the token endpoint. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenResponse is the JSON form of a successful token endpoint response.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (c *ClientCredentials) Header(ctx context.Context, method string) (http.Header, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" || (!c.expiry.IsZero() && time.Now().After(c.expiry.Add(-tokenExpiryDelta))) {
+		if err := c.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return bearerHeader(c.token), nil
+}
+
+// refresh obtains a new token from the token endpoint.
+func (c *ClientCredentials) refresh(ctx context.Context) error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := fmt.Sprintf("token request failed with HTTP status %s", resp.Status)
+		if snippet := strings.TrimSpace(string(b[:min(len(b), maxErrorBodySnippet)])); snippet != "" {
+			message += ": " + snippet
+		}
+		// Rejected client credentials will not be accepted on a retry.
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			return NewError(errors.New(message), codes.Unauthenticated)
+		}
+		return errors.New(message)
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(b, &token); err != nil {
+		return fmt.Errorf("invalid token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return errors.New("token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+	c.token = token.AccessToken
+	c.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		c.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return nil
+}
+
+// credentialsError wraps an error from credentials in an Error.
+func credentialsError(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(fmt.Errorf("failed to get credentials: %w", err), codes.Unavailable)
+}
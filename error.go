@@ -1,9 +1,13 @@
 package sidecar
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/agentio/sidecar/codes"
 )
@@ -36,7 +40,8 @@ func ErrorCode(err error) int {
 		return int(codes.OK)
 	}
 	code := codes.Internal
-	if e, ok := err.(Error); ok {
+	var e *Error
+	if errors.As(err, &e) {
 		code = e.Code()
 	}
 	return int(code)
@@ -51,16 +56,95 @@ func WriteTrailer(w http.ResponseWriter, err error) {
 	w.Header().Set("Trailer:Grpc-Message", err.Error())
 }
 
+// writeTrailersOnly writes a response with its status in the headers and no body.
+func writeTrailersOnly(w http.ResponseWriter, err error) {
+	header := w.Header()
+	header.Set("Content-Type", grpcContentType)
+	header.Set("Grpc-Status", strconv.Itoa(ErrorCode(err)))
+	if err != nil {
+		header.Set("Grpc-Message", err.Error())
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// transportError wraps an error from an HTTP client in an Error.
+// Errors caused by the end of a call's context have the Canceled or
+// DeadlineExceeded codes, and all other failures to reach the server or
+// read its response have the Unavailable code.
+func transportError(ctx context.Context, err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	code := codes.Unavailable
+	switch {
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(ctx.Err(), context.Canceled):
+		code = codes.Canceled
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	return NewError(err, code)
+}
+
+// finishResponse writes the status of a response. Responses that have
+// not sent any messages are written as trailers-only responses.
+func finishResponse(w http.ResponseWriter, sent bool, err error) {
+	if sent {
+		WriteTrailer(w, err)
+	} else {
+		writeTrailersOnly(w, err)
+	}
+}
+
 func ErrorForTrailer(trailer http.Header) error {
 	status := trailer.Get("Grpc-Status")
 	if status == "0" || status == "" {
 		return nil
 	}
-	code, _ := strconv.Atoi(status)
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 || code >= codes.MaxCode {
+		code = int(codes.Unknown)
+	}
 	message := trailer.Get("Grpc-Message")
+	if message == "" {
+		message = codes.Name(codes.Code(code))
+	}
 	return NewError(errors.New(message), codes.Code(code))
 }
 
+// errorForHeader returns the error described by the header of a response.
+// This is the status of a trailers-only response or, for responses without a
+// Grpc-Status, the HTTP status mapped to a gRPC code, which might come from a
+// proxy that is between the client and the server.
+func errorForHeader(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK || resp.Header.Get("Grpc-Status") != "" {
+		return ErrorForTrailer(resp.Header)
+	}
+	message := "unexpected HTTP status " + resp.Status
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySnippet))
+	if snippet := strings.TrimSpace(strings.ToValidUTF8(string(b), "")); snippet != "" {
+		message = fmt.Sprintf("%s: %s", message, snippet)
+	}
+	return NewError(errors.New(message), codes.CodeForHTTPStatus(resp.StatusCode))
+}
+
+// maxErrorBodySnippet limits the amount of a non-gRPC response body that is included in an error.
+const maxErrorBodySnippet = 256
+
+// ErrorForResponse returns the error described by the status of a response,
+// which is in its trailers or, for trailers-only responses, in its headers.
+// Trailers are only available after the response body has been read.
+func ErrorForResponse(resp *http.Response) error {
+	if resp.Trailer.Get("Grpc-Status") != "" {
+		return ErrorForTrailer(resp.Trailer)
+	}
+	return ErrorForTrailer(resp.Header)
+}
+
 func ErrorForCode(code codes.Code) error {
 	return NewError(errors.New(codes.Name(code)), codes.Code(code))
 }
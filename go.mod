@@ -4,6 +4,7 @@ go 1.25.1
 
 require (
 	github.com/spf13/cobra v1.10.1
+	go.yaml.in/yaml/v3 v3.0.4
 	golang.org/x/net v0.46.0
 	google.golang.org/protobuf v1.36.10
 )
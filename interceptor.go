@@ -0,0 +1,139 @@
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// StreamType identifies the kind of an RPC.
+type StreamType int
+
+const (
+	StreamTypeUnary StreamType = iota
+	StreamTypeClient
+	StreamTypeServer
+	StreamTypeBidi
+)
+
+// CallInfo describes an intercepted call.
+type CallInfo struct {
+	// Method is the full path of the method, e.g. "/echo.v1.Echo/Get".
+	Method     string
+	StreamType StreamType
+	// Header holds the request headers. Client interceptors can change them.
+	Header http.Header
+}
+
+// UnaryFunc makes or handles a unary call. Messages are passed as pointers
+// to the request and response types of the method.
+type UnaryFunc func(ctx context.Context, info *CallInfo, req any) (any, error)
+
+// StreamFunc handles a streaming call on a server.
+type StreamFunc func(ctx context.Context, info *CallInfo, stream MessageStream) error
+
+// StreamStartFunc starts a streaming call on a client.
+type StreamStartFunc func(ctx context.Context, info *CallInfo) (MessageStream, error)
+
+// MessageStream is the view of a stream that is seen by interceptors.
+//
+// On servers, Receive returns requests and Send sends responses; the request
+// of a server-streaming call is received like a streamed request, and the
+// response of a client-streaming call is sent like a streamed response.
+// On clients, Send sends requests and Receive returns responses; the request
+// of a server-streaming call is sent like a streamed request.
+// Interceptors can wrap streams to observe or change their messages.
+type MessageStream interface {
+	Send(msg any) error
+	Receive() (any, error)
+}
+
+// ServerInterceptor wraps the handlers of a server. Either function may be nil.
+type ServerInterceptor struct {
+	Unary  func(next UnaryFunc) UnaryFunc
+	Stream func(next StreamFunc) StreamFunc
+}
+
+// ClientInterceptor wraps the calls of a client. Either function may be nil.
+type ClientInterceptor struct {
+	Unary  func(next UnaryFunc) UnaryFunc
+	Stream func(next StreamStartFunc) StreamStartFunc
+}
+
+// Interceptors are applied in order, so the first interceptor is the outermost.
+
+func chainServerUnary(interceptors []ServerInterceptor, fn UnaryFunc) UnaryFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if interceptors[i].Unary != nil {
+			fn = interceptors[i].Unary(fn)
+		}
+	}
+	return fn
+}
+
+func chainServerStream(interceptors []ServerInterceptor, fn StreamFunc) StreamFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if interceptors[i].Stream != nil {
+			fn = interceptors[i].Stream(fn)
+		}
+	}
+	return fn
+}
+
+func chainClientUnary(interceptors []ClientInterceptor, fn UnaryFunc) UnaryFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if interceptors[i].Unary != nil {
+			fn = interceptors[i].Unary(fn)
+		}
+	}
+	return fn
+}
+
+func chainClientStream(interceptors []ClientInterceptor, fn StreamStartFunc) StreamStartFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if interceptors[i].Stream != nil {
+			fn = interceptors[i].Stream(fn)
+		}
+	}
+	return fn
+}
+
+// messageAs converts a message that has passed through interceptors back to its type.
+func messageAs[T any](msg any, err error) (*T, error) {
+	if msg == nil {
+		return nil, err
+	}
+	m, ok := msg.(*T)
+	if !ok {
+		return nil, NewError(fmt.Errorf("interceptor returned %T, expected %T", msg, m), codes.Internal)
+	}
+	return m, err
+}
+
+// serverMessages is the innermost stream of an intercepted streaming handler.
+type serverMessages[Req any] struct {
+	requests *ClientStream[Req]
+	sender   *responseSender
+}
+
+func (s *serverMessages[Req]) Send(msg any) error {
+	return s.sender.send(msg)
+}
+
+func (s *serverMessages[Req]) Receive() (any, error) {
+	return s.requests.Receive()
+}
+
+// handleIntercepted runs an intercepted streaming handler.
+func handleIntercepted[Req any](w http.ResponseWriter, r *http.Request, codec Codec, streamType StreamType, handle StreamFunc) {
+	sender := &responseSender{writer: w, codec: codec}
+	stream := &serverMessages[Req]{
+		requests: &ClientStream[Req]{reader: r.Body, codec: codec},
+		sender:   sender,
+	}
+	info := &CallInfo{Method: r.URL.Path, StreamType: streamType, Header: r.Header}
+	err := handle(incomingContext(r), info, stream)
+	sender.finish(err)
+}
@@ -0,0 +1,268 @@
+package sidecar
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connectionAges closes connections when they reach their maximum age and,
+// if grace is positive, closes them forcibly when the grace period ends.
+type connectionAges struct {
+	age    time.Duration
+	grace  time.Duration
+	mu     sync.Mutex
+	timers map[net.Conn]*time.Timer
+}
+
+// connectionDeadlineKey holds the time at which a connection should be closed gracefully.
+type connectionDeadlineKey struct{}
+
+func (a *connectionAges) connContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = ConnContext(ctx, c)
+	// Like grpc-go, vary ages by up to 10% to spread out reconnections.
+	age := time.Duration(float64(a.age) * (0.9 + 0.2*rand.Float64()))
+	// Like grpc-go, a zero grace period is infinite.
+	if a.grace > 0 {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.timers == nil {
+			a.timers = make(map[net.Conn]*time.Timer)
+		}
+		a.timers[c] = time.AfterFunc(age+a.grace, func() { _ = c.Close() })
+	}
+	return context.WithValue(ctx, connectionDeadlineKey{}, time.Now().Add(age))
+}
+
+func (a *connectionAges) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if timer, ok := a.timers[c]; ok {
+		timer.Stop()
+		delete(a.timers, c)
+	}
+}
+
+// handle asks net/http to close connections that are past their age,
+// which it does for HTTP/2 connections by sending a GOAWAY frame. This is
+// only possible when a request arrives, so connections that don't begin
+// calls after their age are not sent GOAWAY frames.
+func (a *connectionAges) handle(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deadline, ok := r.Context().Value(connectionDeadlineKey{}).(time.Time); ok && time.Now().After(deadline) {
+			w.Header().Set("Connection", "close")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// maxPingStrikes is the number of pings that arrive too soon that are
+// tolerated before a connection is closed, as in grpc-go.
+const maxPingStrikes = 2
+
+// goAwayTimeout is the time that a connection that has sent too many pings is
+// kept open while the server finishes writing a frame before the GOAWAY frame.
+const goAwayTimeout = time.Second
+
+// http2Preface begins every HTTP/2 connection.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// EnforcePingInterval wraps a listener so that the h2c connections that it accepts
+// are closed if their clients send pings more often than a minimum interval. Like
+// grpc-go, it tolerates two pings that arrive too soon before closing a connection,
+// and pings are only counted if no calls have begun and no data has been sent
+// since the previous ping. Before a connection is closed, the client is sent a
+// GOAWAY frame with the ENHANCE_YOUR_CALM error code and "too_many_pings" debug
+// data, as grpc-go does. Other connections, including TLS connections, are not
+// affected.
+func EnforcePingInterval(listener net.Listener, minInterval time.Duration) net.Listener {
+	return &pingPolicyListener{Listener: listener, minInterval: minInterval}
+}
+
+type pingPolicyListener struct {
+	net.Listener
+	minInterval time.Duration
+}
+
+func (l *pingPolicyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &pingPolicyConn{Conn: c, minInterval: l.minInterval}, nil
+}
+
+// pingPolicyConn reads the frames that a client sends to count its pings.
+// It also follows the frames that the server writes, so that it can send
+// a GOAWAY frame between them.
+type pingPolicyConn struct {
+	net.Conn
+	minInterval time.Duration
+	preface     int // the number of bytes of the preface that have been read
+	passthrough bool
+	in          frameScanner
+	lastPing    time.Time
+	strikes     int
+	lastStream  uint32 // the last stream that the client began
+	closing     bool
+
+	mu     sync.Mutex // serializes writes
+	out    frameScanner
+	goAway []byte // a GOAWAY frame to send when the current frame has been written
+	closed bool
+}
+
+// Frame types, flags and error codes from RFC 9113.
+const (
+	http2FrameData              = 0x0
+	http2FrameHeaders           = 0x1
+	http2FramePing              = 0x6
+	http2FrameGoAway            = 0x7
+	http2FlagAck                = 0x1
+	http2ErrCodeEnhanceYourCalm = 0xb
+)
+
+func (c *pingPolicyConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.passthrough && !c.count(p[:n]) {
+		c.close()
+	}
+	return n, err
+}
+
+func (c *pingPolicyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.goAway == nil {
+		n, err := c.Conn.Write(p)
+		for b := p[:n]; len(b) > 0; {
+			k, _ := c.out.advance(b)
+			b = b[k:]
+		}
+		return n, err
+	}
+	// Finish the current frame, then send the GOAWAY frame and close the connection.
+	end := 0
+	for end < len(p) && !c.out.boundary() {
+		k, _ := c.out.advance(p[end:])
+		end += k
+	}
+	n, err := c.Conn.Write(p[:end])
+	if err == nil && c.out.boundary() {
+		c.sendGoAway()
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *pingPolicyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// close sends a GOAWAY frame and closes the connection. If the server is
+// writing a frame, the GOAWAY frame is sent by Write when that frame ends.
+func (c *pingPolicyConn) close() {
+	if c.closing {
+		return
+	}
+	c.closing = true
+	frame := make([]byte, 9, 9+8+len("too_many_pings"))
+	frame = binary.BigEndian.AppendUint32(frame, c.lastStream)
+	frame = binary.BigEndian.AppendUint32(frame, http2ErrCodeEnhanceYourCalm)
+	frame = append(frame, "too_many_pings"...)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-9)<<8|http2FrameGoAway)
+	// Writes may be blocked, so the connection is closed later in any case.
+	time.AfterFunc(goAwayTimeout, func() { _ = c.Conn.Close() })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.goAway = frame
+	if c.out.boundary() {
+		c.sendGoAway()
+	}
+}
+
+// sendGoAway writes the GOAWAY frame and closes the connection. c.mu must be held.
+func (c *pingPolicyConn) sendGoAway() {
+	_, _ = c.Conn.Write(c.goAway)
+	_ = c.Conn.Close()
+	c.closed = true
+}
+
+// count reads frames and returns false if the connection should be closed.
+func (c *pingPolicyConn) count(b []byte) bool {
+	if c.preface < len(http2Preface) {
+		n := min(len(b), len(http2Preface)-c.preface)
+		if !bytes.Equal(b[:n], http2Preface[c.preface:c.preface+n]) {
+			c.passthrough = true
+			return true
+		}
+		c.preface += n
+		b = b[n:]
+	}
+	for len(b) > 0 {
+		n, header := c.in.advance(b)
+		b = b[n:]
+		if header == nil {
+			continue
+		}
+		switch frameType, flags := header[3], header[4]; {
+		case frameType == http2FrameData || frameType == http2FrameHeaders:
+			c.lastPing, c.strikes = time.Time{}, 0
+			if frameType == http2FrameHeaders {
+				c.lastStream = max(c.lastStream, binary.BigEndian.Uint32(header[5:9])&0x7fffffff)
+			}
+		case frameType == http2FramePing && flags&http2FlagAck == 0:
+			now := time.Now()
+			if !c.lastPing.IsZero() && now.Sub(c.lastPing) < c.minInterval {
+				c.strikes++
+				if c.strikes > maxPingStrikes {
+					return false
+				}
+			}
+			c.lastPing = now
+		}
+	}
+	return true
+}
+
+// frameScanner follows the frames of an HTTP/2 connection.
+type frameScanner struct {
+	header    [9]byte
+	headerLen int
+	remaining int // the number of bytes of the current frame's payload that are left
+}
+
+// advance reads from b up to the end of the current frame header or payload. It returns
+// the number of bytes that it read and, if they completed a frame header, the header.
+func (s *frameScanner) advance(b []byte) (int, []byte) {
+	if s.remaining > 0 {
+		n := min(len(b), s.remaining)
+		s.remaining -= n
+		return n, nil
+	}
+	n := copy(s.header[s.headerLen:], b)
+	s.headerLen += n
+	if s.headerLen < len(s.header) {
+		return n, nil
+	}
+	s.headerLen = 0
+	s.remaining = int(binary.BigEndian.Uint32(s.header[0:4]) >> 8)
+	return n, s.header[:]
+}
+
+// boundary reports whether the scanner is between frames.
+func (s *frameScanner) boundary() bool {
+	return s.headerLen == 0 && s.remaining == 0
+}
@@ -0,0 +1,40 @@
+package sidecar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPingPolicyGoAway(t *testing.T) {
+	server, client := net.Pipe()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(client)
+		received <- b
+	}()
+	c := &pingPolicyConn{Conn: server, lastStream: 3}
+	// A DATA frame on stream 1 with a 4-byte payload, and another frame.
+	frame := []byte{0, 0, 4, http2FrameData, 0, 0, 0, 0, 1, 'a', 'b', 'c', 'd'}
+	next := []byte{0, 0, 0, http2FramePing, 0, 0, 0, 0, 0}
+	if _, err := c.Write(frame[:11]); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// The GOAWAY frame waits for the end of the frame that is being written.
+	c.close()
+	n, err := c.Write(append(frame[11:], next...))
+	if n != 2 || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected the rest of the frame to be written before the connection was closed, got %d and %v", n, err)
+	}
+	if _, err := c.Write(next); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected writes to fail after the GOAWAY frame, got %v", err)
+	}
+	b := <-received
+	goAway := []byte{0, 0, 22, http2FrameGoAway, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, http2ErrCodeEnhanceYourCalm}
+	goAway = append(goAway, "too_many_pings"...)
+	if expected := append(frame, goAway...); !bytes.Equal(b, expected) {
+		t.Errorf("expected %v, got %v", expected, b)
+	}
+}
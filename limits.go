@@ -0,0 +1,244 @@
+package sidecar
+
+import (
+	"container/list"
+	"encoding/base64"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Limits configures the limits that HandleLimits applies to each method.
+type Limits struct {
+	// Methods holds the limits of individual methods, by full path (e.g. "/echo.v1.Echo/Get").
+	Methods map[string]MethodLimits
+	// Default holds the limits of each method that is not in Methods.
+	Default MethodLimits
+}
+
+// MethodLimits limits the calls of a method. Zero values mean no limit.
+type MethodLimits struct {
+	// MaxConcurrent is the largest number of calls that can be in progress at once.
+	MaxConcurrent int
+	// Rate is the number of calls allowed per second, on average, with bursts of
+	// up to Burst calls (at least one).
+	Rate  float64
+	Burst int
+	// PerPeer applies the rate to the calls from each client separately. Clients
+	// are identified by their user IDs on unix sockets and by their IP addresses otherwise.
+	PerPeer bool
+}
+
+// maxPeers is the number of per-peer rate limiters that a method keeps. When a
+// new peer calls a method that has this many, the limiter of the peer that called
+// least recently is removed, so that many distinct peers can't use unbounded memory.
+const maxPeers = 1024
+
+// HandleLimits wraps a handler so that gRPC calls that exceed their limits are
+// rejected with ResourceExhausted errors, which have a grpc-retry-pushback-ms
+// header and a google.rpc.RetryInfo detail that tell clients when to retry.
+// Limits are applied when calls are accepted by a handler of this package, such
+// as HandleUnary, so requests for paths without handlers are not limited and
+// don't add limiters. Other requests are passed to the handler unchanged.
+func HandleLimits(handler http.Handler, limits Limits) http.Handler {
+	var mu sync.Mutex
+	limiters := make(map[string]*methodLimiter)
+	limiter := func(method string) *methodLimiter {
+		mu.Lock()
+		defer mu.Unlock()
+		l, ok := limiters[method]
+		if !ok {
+			config, ok := limits.Methods[method]
+			if !ok {
+				config = limits.Default
+			}
+			l = newMethodLimiter(config)
+			limiters[method] = l
+		}
+		return l
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		var acquired *methodLimiter
+		r = r.WithContext(onAccept(r.Context(), func(w http.ResponseWriter, r *http.Request) bool {
+			// Concurrency is checked first, so that rejected calls don't use rate tokens.
+			l := limiter(r.URL.Path)
+			if !l.acquire() {
+				writeRateLimited(w, errors.New("too many concurrent calls"), concurrencyPushback)
+				return false
+			}
+			if delay, ok := l.allow(limitsPeer(r), time.Now()); !ok {
+				l.release()
+				writeRateLimited(w, errors.New("rate limit exceeded"), delay)
+				return false
+			}
+			acquired = l
+			return true
+		}))
+		defer func() {
+			if acquired != nil {
+				acquired.release()
+			}
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyPushback is the delay that clients are asked to wait before retrying
+// calls that exceed a concurrency limit. Unlike the delay of a rate limit, the
+// time until a call ends can't be known, so this is a short fixed delay.
+const concurrencyPushback = 100 * time.Millisecond
+
+// limitsPeer identifies the client of a request for per-peer rate limits.
+func limitsPeer(r *http.Request) string {
+	if creds, ok := r.Context().Value(unixCredentialsKey{}).(*UnixCredentials); ok {
+		return "uid:" + strconv.Itoa(creds.UID)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// methodLimiter applies the limits of a method.
+type methodLimiter struct {
+	limits MethodLimits
+	mu     sync.Mutex
+	active int
+	bucket tokenBucket
+	// peers holds the elements of recent, which are the *peerBucket values of
+	// peers ordered from the most to the least recent caller.
+	peers  map[string]*list.Element
+	recent *list.List
+}
+
+func newMethodLimiter(limits MethodLimits) *methodLimiter {
+	return &methodLimiter{limits: limits, peers: make(map[string]*list.Element), recent: list.New()}
+}
+
+// peerBucket is the rate limiter of a peer.
+type peerBucket struct {
+	peer   string
+	bucket tokenBucket
+}
+
+// allow takes a token for a call from a peer or returns the time until one is available.
+func (l *methodLimiter) allow(peer string, now time.Time) (time.Duration, bool) {
+	if l.limits.Rate <= 0 {
+		return 0, true
+	}
+	burst := float64(max(l.limits.Burst, 1))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.limits.PerPeer {
+		return l.bucket.take(now, l.limits.Rate, burst)
+	}
+	e, ok := l.peers[peer]
+	if ok {
+		l.recent.MoveToFront(e)
+	} else {
+		if l.recent.Len() >= maxPeers {
+			oldest := l.recent.Back()
+			delete(l.peers, oldest.Value.(*peerBucket).peer)
+			l.recent.Remove(oldest)
+		}
+		e = l.recent.PushFront(&peerBucket{peer: peer})
+		l.peers[peer] = e
+	}
+	return e.Value.(*peerBucket).bucket.take(now, l.limits.Rate, burst)
+}
+
+func (l *methodLimiter) acquire() bool {
+	if l.limits.MaxConcurrent <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active >= l.limits.MaxConcurrent {
+		return false
+	}
+	l.active++
+	return true
+}
+
+func (l *methodLimiter) release() {
+	if l.limits.MaxConcurrent <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+}
+
+// tokenBucket holds tokens that are added at a constant rate up to a limit.
+// A bucket that has not been used is full.
+type tokenBucket struct {
+	used   bool
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if !b.used {
+		b.used, b.tokens = true, burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// take removes a token or returns the time until one is available.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (time.Duration, bool) {
+	b.refill(now, rate, burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+}
+
+// writeRateLimited rejects a call that can be retried after a delay.
+func writeRateLimited(w http.ResponseWriter, reason error, delay time.Duration) {
+	err := NewError(reason, codes.ResourceExhausted)
+	ms := int64(math.Ceil(float64(delay) / float64(time.Millisecond)))
+	header := w.Header()
+	header.Set("Grpc-Retry-Pushback-Ms", strconv.FormatInt(ms, 10))
+	header.Set("Grpc-Status-Details-Bin", retryInfoStatus(err, time.Duration(ms)*time.Millisecond))
+	writeTrailersOnly(w, err)
+}
+
+// retryInfoStatus returns the grpc-status-details-bin value for an error with a
+// google.rpc.RetryInfo detail. This is a google.rpc.Status message, which is
+// encoded here to avoid a dependency on generated code for google.rpc types.
+func retryInfoStatus(err error, delay time.Duration) string {
+	// google.rpc.RetryInfo has the delay in field 1.
+	delayBytes, _ := proto.Marshal(durationpb.New(delay))
+	retryInfo := protowire.AppendTag(nil, 1, protowire.BytesType)
+	retryInfo = protowire.AppendBytes(retryInfo, delayBytes)
+	detail, _ := proto.Marshal(&anypb.Any{
+		TypeUrl: "type.googleapis.com/google.rpc.RetryInfo",
+		Value:   retryInfo,
+	})
+	// google.rpc.Status has the code, message and details in fields 1, 2 and 3.
+	status := protowire.AppendTag(nil, 1, protowire.VarintType)
+	status = protowire.AppendVarint(status, uint64(ErrorCode(err)))
+	status = protowire.AppendTag(status, 2, protowire.BytesType)
+	status = protowire.AppendString(status, err.Error())
+	status = protowire.AppendTag(status, 3, protowire.BytesType)
+	status = protowire.AppendBytes(status, detail)
+	return base64.RawStdEncoding.EncodeToString(status)
+}
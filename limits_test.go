@@ -0,0 +1,34 @@
+package sidecar
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPeerLimiters(t *testing.T) {
+	l := newMethodLimiter(MethodLimits{Rate: 0.001, Burst: 1, PerPeer: true})
+	now := time.Now()
+	if _, ok := l.allow("noisy", now); !ok {
+		t.Fatalf("expected the first call of a peer to be allowed")
+	}
+	// Calls from many other peers don't remove the limiter of a peer that keeps calling.
+	for i := range 2 * maxPeers {
+		if _, ok := l.allow("peer"+strconv.Itoa(i), now); !ok {
+			t.Fatalf("expected the first call of peer %d to be allowed", i)
+		}
+		if _, ok := l.allow("noisy", now); ok {
+			t.Fatalf("expected the calls of a noisy peer to be limited after %d other peers", i)
+		}
+	}
+	if len(l.peers) != maxPeers || l.recent.Len() != maxPeers {
+		t.Errorf("expected %d peer limiters, got %d and %d", maxPeers, len(l.peers), l.recent.Len())
+	}
+	// The limiters of the peers that called least recently were removed.
+	if _, ok := l.allow("peer0", now); !ok {
+		t.Errorf("expected the limiter of an old peer to be removed")
+	}
+	if _, ok := l.allow("peer"+strconv.Itoa(2*maxPeers-1), now); ok {
+		t.Errorf("expected the limiter of a recent peer to be kept")
+	}
+}
@@ -0,0 +1,119 @@
+package sidecar
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// Peer describes the client of a call that is being handled.
+type Peer struct {
+	// Addr is the network address of the client.
+	Addr string
+	// TLS is the state of the client's TLS connection, or nil if it is not using TLS.
+	TLS *tls.ConnectionState
+	// Unix holds the credentials of the client process for connections to
+	// unix sockets, where the system provides them, and is nil otherwise.
+	Unix *UnixCredentials
+	// ForwardedCert is the client certificate reported by a trusted proxy,
+	// or nil if there is none. See HandleForwardedClientCert.
+	ForwardedCert *ForwardedClientCert
+	// SPIFFEID is the SPIFFE ID of the client's certificate, which is the forwarded
+	// certificate if there is one and the TLS certificate otherwise, or an empty string.
+	SPIFFEID string
+}
+
+// UnixCredentials identify the process at the other end of a unix socket.
+// They are read with SO_PEERCRED when connections are accepted.
+type UnixCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+type peerKey struct{}
+
+// unixCredentialsKey holds the credentials of the process at the other end of a connection.
+type unixCredentialsKey struct{}
+
+// PeerFromContext returns the client of the call that is handled with a context.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+// ConnContext reads the credentials of processes that connect to unix sockets
+// so that they are available to handlers with PeerFromContext. NewServer uses it
+// as the ConnContext of its servers; other servers can do the same.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	for {
+		wrapper, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = wrapper.NetConn()
+	}
+	if uc, ok := c.(*net.UnixConn); ok {
+		if creds := unixCredentials(uc); creds != nil {
+			return context.WithValue(ctx, unixCredentialsKey{}, creds)
+		}
+	}
+	return ctx
+}
+
+// withPeer returns a context that carries the client of a request.
+func withPeer(ctx context.Context, r *http.Request) context.Context {
+	p := &Peer{Addr: r.RemoteAddr, TLS: r.TLS}
+	p.Unix, _ = r.Context().Value(unixCredentialsKey{}).(*UnixCredentials)
+	p.ForwardedCert, _ = r.Context().Value(forwardedClientCertKey{}).(*ForwardedClientCert)
+	if p.ForwardedCert != nil {
+		p.SPIFFEID = p.ForwardedCert.SPIFFEID()
+	} else if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		for _, uri := range r.TLS.PeerCertificates[0].URIs {
+			if uri.Scheme == "spiffe" {
+				p.SPIFFEID = uri.String()
+				break
+			}
+		}
+	}
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// HandleAllowedUIDs wraps a handler so that methods can only be called by
+// processes with allowed user IDs, which are known for clients that connect
+// to unix sockets. Keys of the allowed map are full method paths (e.g.
+// "/echo.v1.Echo/Get") or service paths that end in a slash (e.g.
+// "/echo.v1.Echo/"), which apply to the methods that have no entries of
+// their own. Calls of restricted methods from other clients fail with
+// PermissionDenied, or with an HTTP 403 response when they don't use the
+// gRPC protocol, and calls of other methods are passed to the handler.
+func HandleAllowedUIDs(handler http.Handler, allowed map[string][]int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uids, ok := allowed[r.URL.Path]
+		if !ok {
+			service, _ := splitMethod(r.URL.Path)
+			uids, ok = allowed["/"+service+"/"]
+		}
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		creds, _ := r.Context().Value(unixCredentialsKey{}).(*UnixCredentials)
+		if creds == nil || !slices.Contains(uids, creds.UID) {
+			message := "caller is not allowed to call " + r.URL.Path
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType) {
+				http.Error(w, message, http.StatusForbidden)
+				return
+			}
+			writeTrailersOnly(w, NewError(errors.New(message), codes.PermissionDenied))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
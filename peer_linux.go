@@ -0,0 +1,23 @@
+package sidecar
+
+import (
+	"net"
+	"syscall"
+)
+
+// unixCredentials reads the credentials of the process at the other end of a connection.
+func unixCredentials(c *net.UnixConn) *UnixCredentials {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ucred *syscall.Ucred
+	var ucredErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || ucredErr != nil {
+		return nil
+	}
+	return &UnixCredentials{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}
+}
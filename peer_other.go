@@ -0,0 +1,10 @@
+//go:build !linux
+
+package sidecar
+
+import "net"
+
+// unixCredentials returns nil on systems without SO_PEERCRED.
+func unixCredentials(c *net.UnixConn) *UnixCredentials {
+	return nil
+}
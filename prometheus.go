@@ -0,0 +1,166 @@
+package sidecar
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the
+// buckets of the call latency histograms of PrometheusStats.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusStats is a StatsHandler that counts calls, messages, and message bytes,
+// and records call latencies in histograms, by method. It serves the metrics in the
+// Prometheus text format, so it can be used as the handler of a /metrics endpoint.
+//
+// Metric names follow the conventions of go-grpc-prometheus, with grpc_server_
+// and grpc_client_ prefixes and grpc_service, grpc_method and grpc_code labels.
+type PrometheusStats struct {
+	buckets []float64
+	mu      sync.Mutex
+	server  map[string]*methodMetrics
+	client  map[string]*methodMetrics
+}
+
+// methodMetrics holds the metrics of a method.
+type methodMetrics struct {
+	started       uint64
+	handled       map[codes.Code]uint64
+	msgReceived   uint64
+	msgSent       uint64
+	bytesReceived uint64
+	bytesSent     uint64
+	buckets       []uint64
+	seconds       float64
+}
+
+// NewPrometheusStats creates a PrometheusStats that records latencies in buckets
+// with the specified upper bounds, or in DefaultLatencyBuckets if there are none.
+func NewPrometheusStats(buckets ...float64) *PrometheusStats {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	return &PrometheusStats{
+		buckets: slices.Sorted(slices.Values(buckets)),
+		server:  make(map[string]*methodMetrics),
+		client:  make(map[string]*methodMetrics),
+	}
+}
+
+func (p *PrometheusStats) HandleStats(ctx context.Context, s *Stats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	methods := p.server
+	if s.Client {
+		methods = p.client
+	}
+	m := methods[s.Method]
+	if m == nil {
+		m = &methodMetrics{handled: make(map[codes.Code]uint64), buckets: make([]uint64, len(p.buckets))}
+		methods[s.Method] = m
+	}
+	switch s.Event {
+	case StatsBegin:
+		m.started++
+	case StatsInPayload:
+		m.msgReceived++
+		m.bytesReceived += uint64(s.Size)
+	case StatsOutPayload:
+		m.msgSent++
+		m.bytesSent += uint64(s.Size)
+	case StatsEnd:
+		m.handled[s.Code]++
+		seconds := s.EndTime.Sub(s.BeginTime).Seconds()
+		m.seconds += seconds
+		if i, _ := slices.BinarySearch(p.buckets, seconds); i < len(p.buckets) {
+			m.buckets[i]++
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (p *PrometheusStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = p.WriteMetrics(w)
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format.
+func (p *PrometheusStats) WriteMetrics(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := bufio.NewWriter(w)
+	for _, side := range []struct {
+		name    string
+		methods map[string]*methodMetrics
+	}{
+		{"server", p.server},
+		{"client", p.client},
+	} {
+		methods := slices.Sorted(maps.Keys(side.methods))
+		counter := func(name, help string, value func(m *methodMetrics) uint64) {
+			name = "grpc_" + side.name + "_" + name
+			fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+			for _, method := range methods {
+				fmt.Fprintf(b, "%s{%s} %d\n", name, methodLabels(method), value(side.methods[method]))
+			}
+		}
+		counter("started_total", "Total number of RPCs started.",
+			func(m *methodMetrics) uint64 { return m.started })
+		name := "grpc_" + side.name + "_handled_total"
+		fmt.Fprintf(b, "# HELP %s Total number of RPCs completed, regardless of success or failure.\n# TYPE %s counter\n", name, name)
+		for _, method := range methods {
+			m := side.methods[method]
+			for _, code := range slices.Sorted(maps.Keys(m.handled)) {
+				fmt.Fprintf(b, "%s{%s,grpc_code=%q} %d\n", name, methodLabels(method), codes.Name(code), m.handled[code])
+			}
+		}
+		counter("msg_received_total", "Total number of stream messages received.",
+			func(m *methodMetrics) uint64 { return m.msgReceived })
+		counter("msg_sent_total", "Total number of stream messages sent.",
+			func(m *methodMetrics) uint64 { return m.msgSent })
+		counter("msg_received_bytes_total", "Total size of stream messages received, in bytes.",
+			func(m *methodMetrics) uint64 { return m.bytesReceived })
+		counter("msg_sent_bytes_total", "Total size of stream messages sent, in bytes.",
+			func(m *methodMetrics) uint64 { return m.bytesSent })
+		name = "grpc_" + side.name + "_handling_seconds"
+		fmt.Fprintf(b, "# HELP %s Histogram of RPC latencies, in seconds.\n# TYPE %s histogram\n", name, name)
+		for _, method := range methods {
+			m := side.methods[method]
+			labels := methodLabels(method)
+			var count uint64
+			for i, bound := range p.buckets {
+				count += m.buckets[i]
+				fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), count)
+			}
+			var total uint64
+			for _, n := range m.handled {
+				total += n
+			}
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, total)
+			fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(m.seconds, 'g', -1, 64))
+			fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, total)
+		}
+	}
+	return b.Flush()
+}
+
+// methodLabels returns the labels that identify a method.
+func methodLabels(method string) string {
+	service, name := splitMethod(method)
+	return fmt.Sprintf("grpc_service=\"%s\",grpc_method=\"%s\"", escapeLabel(service), escapeLabel(name))
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
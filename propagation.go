@@ -0,0 +1,60 @@
+package sidecar
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// DefaultPropagatedHeaders are the headers that clients forward from incoming
+// requests to outgoing calls when their PropagatedHeaders are nil. They carry
+// W3C trace context, Envoy request IDs, and B3 trace context.
+var DefaultPropagatedHeaders = []string{
+	"Traceparent",
+	"Tracestate",
+	"X-Request-Id",
+	"B3",
+	"X-B3-Traceid",
+	"X-B3-Spanid",
+	"X-B3-Parentspanid",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// incomingHeaderKey holds the headers of the request that is being handled.
+type incomingHeaderKey struct{}
+
+// WithIncomingHeader returns a context that carries the headers of an incoming request.
+// Handlers created with the Handle* functions do this for every request, so that calls
+// made with their contexts forward tracing headers. Other servers can use it to do the same.
+func WithIncomingHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, incomingHeaderKey{}, header)
+}
+
+// IncomingHeader returns the headers of the incoming request carried by a context.
+// The headers should not be modified.
+func IncomingHeader(ctx context.Context) (http.Header, bool) {
+	header, ok := ctx.Value(incomingHeaderKey{}).(http.Header)
+	return header, ok
+}
+
+// incomingContext returns the context for handling a request,
+// which carries the request's headers and its peer.
+func incomingContext(r *http.Request) context.Context {
+	return withPeer(WithIncomingHeader(r.Context(), r.Header), r)
+}
+
+// propagateHeaders copies the named headers of the incoming request carried by ctx
+// into the header of an outgoing call. Headers that are already set are not replaced.
+func propagateHeaders(ctx context.Context, header http.Header, names []string) {
+	incoming, ok := IncomingHeader(ctx)
+	if !ok {
+		return
+	}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if values := incoming.Values(name); len(values) > 0 && len(header.Values(name)) == 0 {
+			header[name] = slices.Clone(values)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+	"golang.org/x/net/http2"
+)
+
+// RecordedCall describes a single call captured by a Recorder.
+//
+// Messages are stored as the raw bytes of each gRPC frame payload,
+// which encoding/json writes as base64 strings.
+type RecordedCall struct {
+	Time           time.Time     `json:"time"`
+	Duration       time.Duration `json:"duration_ns"`
+	Method         string        `json:"method"`
+	Header         http.Header   `json:"header,omitempty"`
+	Requests       [][]byte      `json:"requests"`
+	ResponseHeader http.Header   `json:"response_header,omitempty"`
+	Responses      [][]byte      `json:"responses"`
+	Trailer        http.Header   `json:"trailer,omitempty"`
+	Status         codes.Code    `json:"status"`
+	Message        string        `json:"message,omitempty"`
+}
+
+// Recorder writes every call made by a wrapped client to a writer as
+// newline-delimited JSON. It is safe for concurrent use.
+//
+// Authorization headers and the headers of the client's credentials are
+// not recorded, so recordings don't hold secrets.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// secretHeaders holds the names of the headers that credentials have set.
+	secretHeaders sync.Map
+}
+
+// NewRecorder creates a recorder that writes calls to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Wrap returns a copy of a client that records all of its calls.
+// Each call is written when its response body has been fully read or closed.
+func (r *Recorder) Wrap(client *Client) *Client {
+	transport := client.HttpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient := *client.HttpClient
+	httpClient.Transport = &recordingTransport{base: transport, recorder: r}
+	wrapped := *client
+	wrapped.HttpClient = &httpClient
+	if client.Credentials != nil {
+		wrapped.Credentials = &recordingCredentials{base: client.Credentials, recorder: r}
+	}
+	return &wrapped
+}
+
+// recordingCredentials notes the names of the headers that credentials set.
+type recordingCredentials struct {
+	base     PerRPCCredentials
+	recorder *Recorder
+}
+
+func (c *recordingCredentials) Header(ctx context.Context, method string) (http.Header, error) {
+	header, err := c.base.Header(ctx, method)
+	for key := range header {
+		c.recorder.secretHeaders.Store(http.CanonicalHeaderKey(key), true)
+	}
+	return header, err
+}
+
+// recordedHeader returns a copy of a request header without secrets.
+func (r *Recorder) recordedHeader(header http.Header) http.Header {
+	result := header.Clone()
+	result.Del("Authorization")
+	r.secretHeaders.Range(func(key, _ any) bool {
+		result.Del(key.(string))
+		return true
+	})
+	return result
+}
+
+func (r *Recorder) write(call *RecordedCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.enc.Encode(call)
+}
+
+type recordingTransport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := &recording{
+		recorder: t.recorder,
+		start:    time.Now(),
+		call: RecordedCall{
+			Method: req.URL.Path,
+			Header: t.recorder.recordedHeader(req.Header),
+		},
+	}
+	rec.call.Time = rec.start
+	if req.Body != nil {
+		clone := *req
+		clone.Body = &tap{ReadCloser: req.Body, recording: rec, request: true}
+		req = &clone
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		rec.finish(nil, err)
+		return nil, err
+	}
+	rec.mu.Lock()
+	rec.call.ResponseHeader = resp.Header.Clone()
+	rec.mu.Unlock()
+	resp.Body = &tap{ReadCloser: resp.Body, recording: rec, resp: resp}
+	return resp, nil
+}
+
+// recording accumulates the frames of a call while it is in progress.
+type recording struct {
+	recorder *Recorder
+	start    time.Time
+	mu       sync.Mutex
+	call     RecordedCall
+	done     bool
+}
+
+func (r *recording) add(request bool, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if request {
+		r.call.Requests = append(r.call.Requests, b)
+	} else {
+		r.call.Responses = append(r.call.Responses, b)
+	}
+}
+
+func (r *recording) finish(resp *http.Response, err error) {
+	r.mu.Lock()
+	if r.done {
+		r.mu.Unlock()
+		return
+	}
+	r.done = true
+	r.call.Duration = time.Since(r.start)
+	switch {
+	case err != nil:
+		r.call.Status = codes.Unavailable
+		r.call.Message = err.Error()
+	case resp != nil:
+		r.call.Trailer = resp.Trailer.Clone()
+		status := resp.Trailer.Get("Grpc-Status")
+		message := resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status = resp.Header.Get("Grpc-Status")
+			message = resp.Header.Get("Grpc-Message")
+		}
+		if code, err := strconv.Atoi(status); err == nil {
+			r.call.Status = codes.Code(code)
+		}
+		r.call.Message = message
+	}
+	call := r.call
+	r.mu.Unlock()
+	r.recorder.write(&call)
+}
+
+// tap splits the bytes read from a request or response body into gRPC frames.
+type tap struct {
+	io.ReadCloser
+	recording *recording
+	request   bool
+	resp      *http.Response
+	buf       []byte
+}
+
+func (t *tap) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	for len(t.buf) >= 5 {
+		length := int(binary.BigEndian.Uint32(t.buf[1:5]))
+		if len(t.buf) < 5+length {
+			break
+		}
+		t.recording.add(t.request, append([]byte{}, t.buf[5:5+length]...))
+		t.buf = t.buf[5+length:]
+	}
+	if !t.request && err != nil {
+		var streamErr http2.StreamError
+		if errors.Is(err, io.EOF) || (errors.As(err, &streamErr) && streamErr.Code == http2.ErrCodeNo) {
+			t.recording.finish(t.resp, nil)
+		} else {
+			t.recording.finish(nil, err)
+		}
+	}
+	return n, err
+}
+
+func (t *tap) Close() error {
+	err := t.ReadCloser.Close()
+	if !t.request {
+		t.recording.finish(t.resp, nil)
+	}
+	return err
+}
@@ -0,0 +1,318 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// maxAttemptsLimit caps the attempts of retry and hedging policies, as gRPC does.
+const maxAttemptsLimit = 5
+
+// ServiceConfig holds the retry and hedging policies of a gRPC service config.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/service_config.md and
+// https://github.com/grpc/proposal/blob/master/A6-client-retries.md.
+type ServiceConfig struct {
+	Methods []*MethodConfig
+}
+
+// MethodConfig holds the policies for the methods that match any of its names.
+// A call uses at most one of RetryPolicy and HedgingPolicy.
+type MethodConfig struct {
+	Names         []MethodName
+	RetryPolicy   *RetryPolicy
+	HedgingPolicy *HedgingPolicy
+}
+
+// MethodName selects methods for a MethodConfig. A name without a Method
+// selects all methods of the Service, and an empty name selects all methods.
+type MethodName struct {
+	Service string
+	Method  string
+}
+
+// RetryPolicy retries calls that fail with any of the RetryableStatusCodes.
+//
+// Unary calls are retried until they succeed or MaxAttempts is reached, and
+// server-streaming calls are retried until their first response is received.
+// Retries wait for a random time up to a backoff that begins at InitialBackoff
+// and grows by BackoffMultiplier to MaxBackoff, unless the server specifies the
+// wait with grpc-retry-pushback-ms.
+type RetryPolicy struct {
+	MaxAttempts          int
+	InitialBackoff       time.Duration
+	MaxBackoff           time.Duration
+	BackoffMultiplier    float64
+	RetryableStatusCodes []codes.Code
+}
+
+// HedgingPolicy sends up to MaxAttempts copies of a unary call, each HedgingDelay
+// after the previous one, and returns the first result that is successful or
+// that fails with a code that is not in NonFatalStatusCodes.
+type HedgingPolicy struct {
+	MaxAttempts         int
+	HedgingDelay        time.Duration
+	NonFatalStatusCodes []codes.Code
+}
+
+// serviceConfigJSON is the JSON form of a service config.
+type serviceConfigJSON struct {
+	MethodConfig []struct {
+		Name        []MethodName `json:"name"`
+		RetryPolicy *struct {
+			MaxAttempts          int      `json:"maxAttempts"`
+			InitialBackoff       string   `json:"initialBackoff"`
+			MaxBackoff           string   `json:"maxBackoff"`
+			BackoffMultiplier    float64  `json:"backoffMultiplier"`
+			RetryableStatusCodes []string `json:"retryableStatusCodes"`
+		} `json:"retryPolicy"`
+		HedgingPolicy *struct {
+			MaxAttempts         int      `json:"maxAttempts"`
+			HedgingDelay        string   `json:"hedgingDelay"`
+			NonFatalStatusCodes []string `json:"nonFatalStatusCodes"`
+		} `json:"hedgingPolicy"`
+	} `json:"methodConfig"`
+}
+
+// ParseServiceConfig reads the retry and hedging policies of a gRPC service config
+// from its JSON form. Other parts of the service config are ignored.
+func ParseServiceConfig(b []byte) (*ServiceConfig, error) {
+	var j serviceConfigJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, fmt.Errorf("invalid service config: %w", err)
+	}
+	config := &ServiceConfig{}
+	for i, m := range j.MethodConfig {
+		mc := &MethodConfig{Names: m.Name}
+		if m.RetryPolicy != nil && m.HedgingPolicy != nil {
+			return nil, fmt.Errorf("methodConfig %d: retryPolicy and hedgingPolicy cannot both be set", i)
+		}
+		if p := m.RetryPolicy; p != nil {
+			initialBackoff, err := parseConfigDuration(p.InitialBackoff)
+			if err != nil {
+				return nil, fmt.Errorf("methodConfig %d: initialBackoff: %w", i, err)
+			}
+			maxBackoff, err := parseConfigDuration(p.MaxBackoff)
+			if err != nil {
+				return nil, fmt.Errorf("methodConfig %d: maxBackoff: %w", i, err)
+			}
+			retryable, err := parseConfigCodes(p.RetryableStatusCodes)
+			if err != nil {
+				return nil, fmt.Errorf("methodConfig %d: retryableStatusCodes: %w", i, err)
+			}
+			switch {
+			case p.MaxAttempts < 2:
+				return nil, fmt.Errorf("methodConfig %d: maxAttempts must be at least 2", i)
+			case initialBackoff <= 0 || maxBackoff <= 0:
+				return nil, fmt.Errorf("methodConfig %d: backoffs must be positive", i)
+			case p.BackoffMultiplier <= 0:
+				return nil, fmt.Errorf("methodConfig %d: backoffMultiplier must be positive", i)
+			case len(retryable) == 0:
+				return nil, fmt.Errorf("methodConfig %d: retryableStatusCodes must not be empty", i)
+			}
+			mc.RetryPolicy = &RetryPolicy{
+				MaxAttempts:          min(p.MaxAttempts, maxAttemptsLimit),
+				InitialBackoff:       initialBackoff,
+				MaxBackoff:           maxBackoff,
+				BackoffMultiplier:    p.BackoffMultiplier,
+				RetryableStatusCodes: retryable,
+			}
+		}
+		if p := m.HedgingPolicy; p != nil {
+			var delay time.Duration
+			if p.HedgingDelay != "" {
+				var err error
+				if delay, err = parseConfigDuration(p.HedgingDelay); err != nil {
+					return nil, fmt.Errorf("methodConfig %d: hedgingDelay: %w", i, err)
+				}
+			}
+			nonFatal, err := parseConfigCodes(p.NonFatalStatusCodes)
+			if err != nil {
+				return nil, fmt.Errorf("methodConfig %d: nonFatalStatusCodes: %w", i, err)
+			}
+			if p.MaxAttempts < 2 {
+				return nil, fmt.Errorf("methodConfig %d: maxAttempts must be at least 2", i)
+			}
+			mc.HedgingPolicy = &HedgingPolicy{
+				MaxAttempts:         min(p.MaxAttempts, maxAttemptsLimit),
+				HedgingDelay:        delay,
+				NonFatalStatusCodes: nonFatal,
+			}
+		}
+		config.Methods = append(config.Methods, mc)
+	}
+	return config, nil
+}
+
+// parseConfigDuration parses a duration in the protobuf JSON form, e.g. "0.5s".
+func parseConfigDuration(s string) (time.Duration, error) {
+	if !strings.HasSuffix(s, "s") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.ParseDuration(s)
+}
+
+// parseConfigCodes parses status codes written as names (e.g. "UNAVAILABLE") or numbers.
+func parseConfigCodes(names []string) ([]codes.Code, error) {
+	var result []codes.Code
+	for _, name := range names {
+		code, ok := codes.Parse(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid status code %q", name)
+		}
+		result = append(result, code)
+	}
+	return result, nil
+}
+
+// methodConfig returns the most specific configuration for a method, which is
+// specified by its full path (e.g. "/echo.v1.Echo/Get"), or nil if there is none.
+func (c *ServiceConfig) methodConfig(method string) *MethodConfig {
+	if c == nil {
+		return nil
+	}
+	service, name := splitMethod(method)
+	var serviceMatch, defaultMatch *MethodConfig
+	for _, mc := range c.Methods {
+		for _, n := range mc.Names {
+			switch {
+			case n.Service == service && n.Method == name:
+				return mc
+			case n.Service == service && n.Method == "" && serviceMatch == nil:
+				serviceMatch = mc
+			case n.Service == "" && n.Method == "" && defaultMatch == nil:
+				defaultMatch = mc
+			}
+		}
+	}
+	if serviceMatch != nil {
+		return serviceMatch
+	}
+	return defaultMatch
+}
+
+// attemptFunc makes one attempt of a call. Along with the result, it returns
+// the header that holds the call's status, which may contain a retry pushback.
+type attemptFunc[T any] func(ctx context.Context) (T, http.Header, error)
+
+// invoke makes a call with the policies of a method configuration.
+func invoke[T any](ctx context.Context, config *MethodConfig, attempt attemptFunc[T]) (T, error) {
+	switch {
+	case config != nil && config.HedgingPolicy != nil:
+		return hedge(ctx, config.HedgingPolicy, attempt)
+	case config != nil && config.RetryPolicy != nil:
+		return retry(ctx, config.RetryPolicy, attempt)
+	default:
+		result, _, err := attempt(ctx)
+		return result, err
+	}
+}
+
+func retry[T any](ctx context.Context, policy *RetryPolicy, attempt attemptFunc[T]) (T, error) {
+	backoff := policy.InitialBackoff
+	for n := 1; ; n++ {
+		result, md, err := attempt(ctx)
+		if err == nil || n >= policy.MaxAttempts ||
+			!slices.Contains(policy.RetryableStatusCodes, codes.Code(ErrorCode(err))) {
+			return result, err
+		}
+		delay, ok := retryPushback(md)
+		if !ok {
+			return result, err
+		}
+		if delay < 0 {
+			delay = time.Duration(rand.Int64N(int64(backoff) + 1))
+			backoff = min(time.Duration(float64(backoff)*policy.BackoffMultiplier), policy.MaxBackoff)
+		} else {
+			// Backoff begins again after a pushback.
+			backoff = policy.InitialBackoff
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+	}
+}
+
+func hedge[T any](ctx context.Context, policy *HedgingPolicy, attempt attemptFunc[T]) (T, error) {
+	// Cancel the attempts that are still running when a result is returned.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type outcome struct {
+		result T
+		md     http.Header
+		err    error
+	}
+	outcomes := make(chan outcome, policy.MaxAttempts)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	started, finished := 0, 0
+	stop := false
+	var last outcome
+	for {
+		select {
+		case <-timer.C:
+			started++
+			go func() {
+				result, md, err := attempt(ctx)
+				outcomes <- outcome{result: result, md: md, err: err}
+			}()
+			if started < policy.MaxAttempts {
+				timer.Reset(policy.HedgingDelay)
+			}
+		case o := <-outcomes:
+			finished++
+			if o.err == nil || !slices.Contains(policy.NonFatalStatusCodes, codes.Code(ErrorCode(o.err))) {
+				return o.result, o.err
+			}
+			last = o
+			delay, ok := retryPushback(o.md)
+			if !ok {
+				// The server has asked for no more attempts.
+				timer.Stop()
+				stop = true
+			}
+			switch {
+			case stop || started == policy.MaxAttempts:
+			case delay >= 0:
+				timer.Reset(delay)
+			case finished == started:
+				// Nothing is outstanding, so send the next attempt now.
+				timer.Reset(0)
+			}
+			if finished == started && (stop || started == policy.MaxAttempts) {
+				return last.result, last.err
+			}
+		case <-ctx.Done():
+			var zero T
+			return zero, transportError(ctx, ctx.Err())
+		}
+	}
+}
+
+// retryPushback reads the grpc-retry-pushback-ms value that servers use to delay
+// or prevent retries. It returns a negative delay if there is no pushback and
+// false if the server has asked clients not to retry.
+func retryPushback(md http.Header) (time.Duration, bool) {
+	value := md.Get("Grpc-Retry-Pushback-Ms")
+	if value == "" {
+		return -1, true
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
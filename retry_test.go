@@ -0,0 +1,79 @@
+package sidecar
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+func TestParseServiceConfig(t *testing.T) {
+	const retry = `"retryPolicy": {"maxAttempts": 3, "initialBackoff": "0.1s", "maxBackoff": "1s", "backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE"]}`
+	const hedging = `"hedgingPolicy": {"maxAttempts": 3, "hedgingDelay": "0.5s", "nonFatalStatusCodes": ["UNAVAILABLE", "14"]}`
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{name: "retry", config: `{"methodConfig": [{"name": [{"service": "echo.v1.Echo"}], ` + retry + `}]}`},
+		{name: "hedging", config: `{"methodConfig": [{"name": [{}], ` + hedging + `}]}`},
+		{name: "no policies", config: `{"methodConfig": [{"name": [{}]}]}`},
+		{name: "invalid JSON", config: `{"methodConfig": [`, err: "invalid service config"},
+		{name: "both policies", config: `{"methodConfig": [{` + retry + `, ` + hedging + `}]}`, err: "retryPolicy and hedgingPolicy cannot both be set"},
+		{name: "retry maxAttempts", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 1, "initialBackoff": "0.1s", "maxBackoff": "1s", "backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`, err: "maxAttempts must be at least 2"},
+		{name: "hedging maxAttempts", config: `{"methodConfig": [{"hedgingPolicy": {"maxAttempts": 1}}]}`, err: "maxAttempts must be at least 2"},
+		{name: "duration suffix", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "100ms", "maxBackoff": "1m", "backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`, err: `maxBackoff: invalid duration "1m"`},
+		{name: "duration missing", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "maxBackoff": "1s", "backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`, err: `initialBackoff: invalid duration ""`},
+		{name: "duration value", config: `{"methodConfig": [{"hedgingPolicy": {"maxAttempts": 2, "hedgingDelay": "fasts"}}]}`, err: "hedgingDelay: time: invalid duration"},
+		{name: "zero backoff", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "0s", "maxBackoff": "1s", "backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`, err: "backoffs must be positive"},
+		{name: "zero multiplier", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "0.1s", "maxBackoff": "1s", "retryableStatusCodes": ["UNAVAILABLE"]}}]}`, err: "backoffMultiplier must be positive"},
+		{name: "no retryable codes", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "0.1s", "maxBackoff": "1s", "backoffMultiplier": 2}}]}`, err: "retryableStatusCodes must not be empty"},
+		{name: "unknown retryable code", config: `{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "0.1s", "maxBackoff": "1s", "backoffMultiplier": 2, "retryableStatusCodes": ["NOT_A_CODE"]}}]}`, err: `retryableStatusCodes: invalid status code "NOT_A_CODE"`},
+		{name: "unknown non-fatal code", config: `{"methodConfig": [{"hedgingPolicy": {"maxAttempts": 2, "nonFatalStatusCodes": ["17"]}}]}`, err: `nonFatalStatusCodes: invalid status code "17"`},
+	} {
+		config, err := ParseServiceConfig([]byte(test.config))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		case test.err == "" && len(config.Methods) != 1:
+			t.Errorf("%s: expected one method config, got %d", test.name, len(config.Methods))
+		}
+	}
+}
+
+func TestParseServiceConfigPolicies(t *testing.T) {
+	config, err := ParseServiceConfig([]byte(`{"methodConfig": [
+		{"name": [{"service": "echo.v1.Echo", "method": "Get"}], "retryPolicy": {"maxAttempts": 9, "initialBackoff": "0.1s", "maxBackoff": "1.5s", "backoffMultiplier": 2, "retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]}},
+		{"name": [{"service": "echo.v1.Echo"}], "hedgingPolicy": {"maxAttempts": 3, "hedgingDelay": "0.5s", "nonFatalStatusCodes": ["14"]}}
+	]}`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	retry := config.methodConfig("/echo.v1.Echo/Get").RetryPolicy
+	switch {
+	case retry == nil:
+		t.Fatalf("expected a retry policy for Get")
+	case retry.MaxAttempts != maxAttemptsLimit:
+		t.Errorf("expected maxAttempts to be capped at %d, got %d", maxAttemptsLimit, retry.MaxAttempts)
+	case retry.InitialBackoff != 100*time.Millisecond || retry.MaxBackoff != 1500*time.Millisecond:
+		t.Errorf("unexpected backoffs %s and %s", retry.InitialBackoff, retry.MaxBackoff)
+	case !slices.Equal(retry.RetryableStatusCodes, []codes.Code{codes.Unavailable, codes.ResourceExhausted}):
+		t.Errorf("unexpected retryable codes %v", retry.RetryableStatusCodes)
+	}
+	hedging := config.methodConfig("/echo.v1.Echo/Expand").HedgingPolicy
+	switch {
+	case hedging == nil:
+		t.Fatalf("expected a hedging policy for Expand")
+	case hedging.MaxAttempts != 3 || hedging.HedgingDelay != 500*time.Millisecond:
+		t.Errorf("unexpected hedging policy %+v", hedging)
+	case !slices.Equal(hedging.NonFatalStatusCodes, []codes.Code{codes.Unavailable}):
+		t.Errorf("unexpected non-fatal codes %v", hedging.NonFatalStatusCodes)
+	}
+	if config.methodConfig("/other.v1.Other/Get") != nil {
+		t.Errorf("expected no method config for another service")
+	}
+}
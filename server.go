@@ -1,10 +1,22 @@
 package sidecar
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+)
 
 // NewServer creates an http.Server instance that is configured for h2c communication.
 //
 // With appropriate handlers, this can be used to run gRPC services.
+// Its ConnContext makes the credentials of clients that connect to
+// unix sockets available to handlers.
 func NewServer(handler http.Handler) *http.Server {
 	// Configure protocols for h2c-only support (HTTP/2 cleartext)
 	protocols := new(http.Protocols)
@@ -12,7 +24,161 @@ func NewServer(handler http.Handler) *http.Server {
 	protocols.SetHTTP1(false)           // Explicitly disable HTTP/1.1
 	protocols.SetHTTP2(false)           // Explicitly disable encrypted HTTP/2 (HTTPS)
 	return &http.Server{
-		Handler:   handler,
-		Protocols: protocols,
+		Handler:     handler,
+		Protocols:   protocols,
+		ConnContext: ConnContext,
+	}
+}
+
+// ServerOptions configure servers created with NewServerWithOptions.
+// Zero values use the defaults of net/http, and the limits of net/http apply.
+type ServerOptions struct {
+	// InitialStreamWindowSize and InitialConnWindowSize are the HTTP/2 flow
+	// control windows for data received on each stream and on each connection.
+	InitialStreamWindowSize int
+	InitialConnWindowSize   int
+	// MaxFrameSize is the largest HTTP/2 frame that the server will read.
+	MaxFrameSize int
+	// MaxHeaderListSize is the largest size of request headers that the server will read.
+	MaxHeaderListSize int
+	// MaxConcurrentStreams is the number of calls that each client connection can make at once.
+	MaxConcurrentStreams int
+	// PingInterval is the time without any frames from a client after which
+	// the server pings it, and PingTimeout is the time after which the
+	// connection is closed if the ping is not answered. These and the
+	// following options mirror the keepalive parameters of grpc-go servers.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// MaxConnectionIdle is the time after which connections without calls are closed.
+	MaxConnectionIdle time.Duration
+	// MaxConnectionAge is the time after which connections are asked to close,
+	// give or take 10%. Unlike grpc-go servers, which send GOAWAY frames when
+	// connections reach their age, servers can only ask net/http to send them
+	// when calls begin, so only connections that begin calls after their age
+	// are closed gracefully. Connections that begin no more calls, such as idle
+	// connections or ones that carry a single long-lived stream, stay open
+	// until they are closed by MaxConnectionIdle or MaxConnectionAgeGrace.
+	// If MaxConnectionAgeGrace is positive, connections are closed that long
+	// after they reach their age, even if calls are still in progress. If it is
+	// zero, the grace period is infinite, as in grpc-go.
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+}
+
+// NewServerWithOptions creates an http.Server instance that is configured for h2c
+// communication, as NewServer does, with the specified options.
+func NewServerWithOptions(handler http.Handler, options ServerOptions) *http.Server {
+	server := NewServer(handler)
+	server.HTTP2 = &http.HTTP2Config{
+		MaxConcurrentStreams:          options.MaxConcurrentStreams,
+		MaxReadFrameSize:              options.MaxFrameSize,
+		MaxReceiveBufferPerConnection: options.InitialConnWindowSize,
+		MaxReceiveBufferPerStream:     options.InitialStreamWindowSize,
+		SendPingTimeout:               options.PingInterval,
+		PingTimeout:                   options.PingTimeout,
 	}
+	server.MaxHeaderBytes = options.MaxHeaderListSize
+	server.IdleTimeout = options.MaxConnectionIdle
+	if options.MaxConnectionAge > 0 {
+		ages := &connectionAges{age: options.MaxConnectionAge, grace: options.MaxConnectionAgeGrace}
+		server.Handler = ages.handle(server.Handler)
+		server.ConnContext = ages.connContext
+		server.ConnState = ages.connState
+	}
+	return server
+}
+
+// translatedKey marks requests that were translated from another protocol,
+// such as gRPC-Web or Connect, and may therefore arrive over HTTP/1.1.
+type translatedKey struct{}
+
+func withTranslated(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), translatedKey{}, true))
+}
+
+// acceptHooksKey holds the functions that are called when a handler accepts a request.
+type acceptHooksKey struct{}
+
+// acceptHook is called when a handler accepts a request. If it rejects the
+// request, it writes the response and returns false.
+type acceptHook func(w http.ResponseWriter, r *http.Request) bool
+
+// onAccept returns a context in which a hook is called when a handler accepts a request.
+// Wrappers use hooks to act only on requests that reach a registered handler,
+// so that they don't keep state for arbitrary paths.
+func onAccept(ctx context.Context, hook acceptHook) context.Context {
+	hooks, _ := ctx.Value(acceptHooksKey{}).([]acceptHook)
+	return context.WithValue(ctx, acceptHooksKey{}, append(hooks[:len(hooks):len(hooks)], hook))
+}
+
+// acceptRequest checks that a request is a valid gRPC request and selects its codec.
+//
+// Requests that don't use POST are rejected with HTTP 405, and requests without
+// an application/grpc content type are rejected with HTTP 415. Other protocol
+// errors are reported with trailers-only responses. Valid requests are passed
+// to the hooks of onAccept, which may reject them. If the request is rejected,
+// the response is written and false is returned.
+func acceptRequest(w http.ResponseWriter, r *http.Request) (Codec, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("gRPC requests must use POST, not %s", r.Method), http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType != grpcContentType &&
+		!strings.HasPrefix(contentType, grpcContentType+"+") &&
+		!strings.HasPrefix(contentType, grpcContentType+";") {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	if r.ProtoMajor != 2 && r.Context().Value(translatedKey{}) == nil {
+		writeTrailersOnly(w, NewError(fmt.Errorf("gRPC requires HTTP/2, got %s", r.Proto), codes.Internal))
+		return nil, false
+	}
+	codec, err := codecForContentType(contentType)
+	if err != nil {
+		writeTrailersOnly(w, err)
+		return nil, false
+	}
+	hooks, _ := r.Context().Value(acceptHooksKey{}).([]acceptHook)
+	for _, hook := range hooks {
+		if !hook(w, r) {
+			return nil, false
+		}
+	}
+	w.Header().Set("Content-Type", contentTypeForCodec(codec))
+	return codec, true
+}
+
+// responseSender writes the response messages of a streaming handler.
+//
+// Sends are serialized, so handlers can send from several goroutines, and
+// sends that are attempted after the handler has returned fail.
+type responseSender struct {
+	mu     sync.Mutex
+	writer http.ResponseWriter
+	codec  Codec
+	sent   bool
+	done   bool
+}
+
+func (s *responseSender) send(msg any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return NewError(errors.New("send after the handler returned"), codes.FailedPrecondition)
+	}
+	err := send(s.writer, msg, s.codec)
+	if err == nil {
+		s.sent = true
+	}
+	return err
+}
+
+// finish writes the status of the response and prevents further sends.
+func (s *responseSender) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	finishResponse(s.writer, s.sent, err)
 }
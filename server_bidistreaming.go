@@ -2,36 +2,111 @@ package sidecar
 
 import (
 	"context"
+	"errors"
 	"io"
+	"iter"
 	"net/http"
+	"sync"
+
+	"github.com/agentio/sidecar/codes"
 )
 
 // BidiStream provides messaging to bidi streaming handlers.
+//
+// Send and Receive may be called concurrently, and each may be
+// called from any goroutine until the handler returns.
 type BidiStream[Req, Res any] struct {
-	reader io.ReadCloser
-	writer http.ResponseWriter
+	ctx      context.Context
+	reader   io.ReadCloser
+	codec    Codec
+	sender   responseSender
+	mu       sync.Mutex
+	messages MessageStream // set when interceptors are used
 }
 
 // Send sends a response message on a bidi stream.
 func (b *BidiStream[Req, Res]) Send(msg *Res) error {
-	return Send(b.writer, msg)
+	if b.messages != nil {
+		return b.streamError(b.messages.Send(msg))
+	}
+	return b.streamError(b.sender.send(msg))
 }
 
 // Receive reads a request message from a bidi stream.
 func (b *BidiStream[Req, Res]) Receive() (*Req, error) {
+	if b.messages != nil {
+		request, err := messageAs[Req](b.messages.Receive())
+		return request, b.streamError(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	var request Req
-	err := Receive(b.reader, &request)
-	return &request, err
+	err := receive(b.reader, &request, b.codec)
+	return &request, b.streamError(err)
+}
+
+// All returns an iterator over the request messages from a bidi stream.
+// The iteration ends at the end of the stream or after yielding an error.
+func (b *BidiStream[Req, Res]) All() iter.Seq2[*Req, error] {
+	return func(yield func(*Req, error) bool) {
+		for {
+			request, err := b.Receive()
+			if errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(request, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Context returns the context of the call, which is cancelled
+// when the client cancels the call or resets its stream.
+func (b *BidiStream[Req, Res]) Context() context.Context {
+	return b.ctx
+}
+
+// streamError reports failures that are caused by the end of the call as cancellations.
+func (b *BidiStream[Req, Res]) streamError(err error) error {
+	if err != nil && !errors.Is(err, io.EOF) && b.ctx.Err() != nil {
+		return NewError(b.ctx.Err(), codes.Canceled)
+	}
+	return err
 }
 
 // Bidi streaming handlers should be functions that implement this interface.
 type BidiStreamingFunction[Req, Res any] func(ctx context.Context, stream *BidiStream[Req, Res]) error
 
 // HandleBidiStreaming wraps a bidi streaming function in an HTTP handler.
-func HandleBidiStreaming[Req any, Res any](fn BidiStreamingFunction[Req, Res]) func(w http.ResponseWriter, r *http.Request) {
+// Calls pass through any interceptors in order.
+func HandleBidiStreaming[Req any, Res any](fn BidiStreamingFunction[Req, Res], interceptors ...ServerInterceptor) func(w http.ResponseWriter, r *http.Request) {
+	var intercepted StreamFunc
+	if len(interceptors) > 0 {
+		intercepted = chainServerStream(interceptors, func(ctx context.Context, info *CallInfo, stream MessageStream) error {
+			return fn(ctx, &BidiStream[Req, Res]{ctx: ctx, messages: stream})
+		})
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/grpc")
-		err := fn(r.Context(), &BidiStream[Req, Res]{reader: r.Body, writer: w})
-		WriteTrailer(w, err)
+		codec, ok := acceptRequest(w, r)
+		if !ok {
+			return
+		}
+		if intercepted != nil {
+			handleIntercepted[Req](w, r, codec, StreamTypeBidi, intercepted)
+			return
+		}
+		ctx := incomingContext(r)
+		stream := &BidiStream[Req, Res]{
+			ctx:    ctx,
+			reader: r.Body,
+			codec:  codec,
+			sender: responseSender{writer: w, codec: codec},
+		}
+		err := fn(ctx, stream)
+		stream.sender.finish(err)
 	}
 }
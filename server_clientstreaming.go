@@ -2,35 +2,87 @@ package sidecar
 
 import (
 	"context"
+	"errors"
 	"io"
+	"iter"
 	"net/http"
+	"sync"
 )
 
 // ClientStream provides messaging to client streaming handlers.
+//
+// Receive may be called from any goroutine until the handler returns.
 type ClientStream[Req any] struct {
-	reader io.ReadCloser
+	reader   io.ReadCloser
+	codec    Codec
+	mu       sync.Mutex
+	messages MessageStream // set when interceptors are used
 }
 
 // Receive reads a request message from a client stream.
 func (b *ClientStream[Req]) Receive() (*Req, error) {
+	if b.messages != nil {
+		return messageAs[Req](b.messages.Receive())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	var request Req
-	err := Receive(b.reader, &request)
+	err := receive(b.reader, &request, b.codec)
 	return &request, err
 }
 
+// All returns an iterator over the request messages from a client stream.
+// The iteration ends at the end of the stream or after yielding an error.
+func (b *ClientStream[Req]) All() iter.Seq2[*Req, error] {
+	return func(yield func(*Req, error) bool) {
+		for {
+			request, err := b.Receive()
+			if errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(request, nil) {
+				return
+			}
+		}
+	}
+}
+
 // Client streaming handlers should be functions that implement this interface.
 type ClientStreamingFunction[Req, Res any] func(ctx context.Context, stream *ClientStream[Req]) (*Response[Res], error)
 
 // HandleClientStreaming wraps a client streaming function in an HTTP handler.
-func HandleClientStreaming[Req any, Res any](fn ClientStreamingFunction[Req, Res]) func(w http.ResponseWriter, r *http.Request) {
+// Calls pass through any interceptors in order.
+func HandleClientStreaming[Req any, Res any](fn ClientStreamingFunction[Req, Res], interceptors ...ServerInterceptor) func(w http.ResponseWriter, r *http.Request) {
+	var intercepted StreamFunc
+	if len(interceptors) > 0 {
+		intercepted = chainServerStream(interceptors, func(ctx context.Context, info *CallInfo, stream MessageStream) error {
+			response, err := fn(ctx, &ClientStream[Req]{messages: stream})
+			if err != nil {
+				return err
+			}
+			return stream.Send(response.Msg)
+		})
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/grpc")
-		response, err := fn(r.Context(), &ClientStream[Req]{reader: r.Body})
+		codec, ok := acceptRequest(w, r)
+		if !ok {
+			return
+		}
+		if intercepted != nil {
+			handleIntercepted[Req](w, r, codec, StreamTypeClient, intercepted)
+			return
+		}
+		sent := false
+		response, err := fn(incomingContext(r), &ClientStream[Req]{reader: r.Body, codec: codec})
 		if err != nil {
 			goto end
 		}
-		err = Send(w, response.Msg)
+		err = send(w, response.Msg, codec)
+		sent = err == nil
 	end:
-		WriteTrailer(w, err)
+		finishResponse(w, sent, err)
 	}
 }
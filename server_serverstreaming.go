@@ -6,29 +6,55 @@ import (
 )
 
 // ServerStream provides messaging to server streaming handlers.
+//
+// Send may be called from any goroutine until the handler returns.
 type ServerStream[Res any] struct {
-	writer http.ResponseWriter
+	sender   responseSender
+	messages MessageStream // set when interceptors are used
 }
 
 // Send sends a response message on a server stream.
 func (b *ServerStream[Res]) Send(msg *Res) error {
-	return Send(b.writer, msg)
+	if b.messages != nil {
+		return b.messages.Send(msg)
+	}
+	return b.sender.send(msg)
 }
 
 // Server streaming handlers should be functions that implement this interface.
 type ServerStreamingFunction[Req, Res any] func(ctx context.Context, request *Request[Req], stream *ServerStream[Res]) error
 
 // HandleServerStreaming wraps a server streaming function in an HTTP handler.
-func HandleServerStreaming[Req any, Res any](fn ServerStreamingFunction[Req, Res]) func(w http.ResponseWriter, r *http.Request) {
+// Calls pass through any interceptors in order.
+func HandleServerStreaming[Req any, Res any](fn ServerStreamingFunction[Req, Res], interceptors ...ServerInterceptor) func(w http.ResponseWriter, r *http.Request) {
+	var intercepted StreamFunc
+	if len(interceptors) > 0 {
+		intercepted = chainServerStream(interceptors, func(ctx context.Context, info *CallInfo, stream MessageStream) error {
+			request, err := messageAs[Req](stream.Receive())
+			if err != nil {
+				return err
+			}
+			return fn(ctx, &Request[Req]{Msg: request}, &ServerStream[Res]{messages: stream})
+		})
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/grpc")
+		codec, ok := acceptRequest(w, r)
+		if !ok {
+			return
+		}
+		if intercepted != nil {
+			handleIntercepted[Req](w, r, codec, StreamTypeServer, intercepted)
+			return
+		}
+		ctx := incomingContext(r)
 		var request Req
-		err := Receive(r.Body, &request)
+		stream := &ServerStream[Res]{sender: responseSender{writer: w, codec: codec}}
+		err := receive(r.Body, &request, codec)
 		if err != nil {
 			goto end
 		}
-		err = fn(r.Context(), &Request[Req]{Msg: &request}, &ServerStream[Res]{writer: w})
+		err = fn(ctx, &Request[Req]{Msg: &request}, stream)
 	end:
-		WriteTrailer(w, err)
+		stream.sender.finish(err)
 	}
 }
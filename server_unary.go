@@ -9,21 +9,49 @@ import (
 type UnaryFunction[Req, Res any] func(ctx context.Context, request *Request[Req]) (*Response[Res], error)
 
 // HandleUnary wraps a unary function in an HTTP handler.
-func HandleUnary[Req any, Res any](fn UnaryFunction[Req, Res]) func(w http.ResponseWriter, r *http.Request) {
+// Calls pass through any interceptors in order.
+func HandleUnary[Req any, Res any](fn UnaryFunction[Req, Res], interceptors ...ServerInterceptor) func(w http.ResponseWriter, r *http.Request) {
+	var intercepted UnaryFunc
+	if len(interceptors) > 0 {
+		intercepted = chainServerUnary(interceptors, func(ctx context.Context, info *CallInfo, req any) (any, error) {
+			request, err := messageAs[Req](req, nil)
+			if err != nil {
+				return nil, err
+			}
+			response, err := fn(ctx, &Request[Req]{Msg: request})
+			if err != nil {
+				return nil, err
+			}
+			return response.Msg, nil
+		})
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/grpc")
+		codec, ok := acceptRequest(w, r)
+		if !ok {
+			return
+		}
+		ctx := incomingContext(r)
 		var request Req
 		var response *Response[Res]
-		err := Receive(r.Body, &request)
+		sent := false
+		err := receive(r.Body, &request, codec)
 		if err != nil {
 			goto end
 		}
-		response, err = fn(r.Context(), &Request[Req]{Msg: &request})
+		if intercepted != nil {
+			info := &CallInfo{Method: r.URL.Path, StreamType: StreamTypeUnary, Header: r.Header}
+			var msg *Res
+			msg, err = messageAs[Res](intercepted(ctx, info, &request))
+			response = NewResponse(msg)
+		} else {
+			response, err = fn(ctx, &Request[Req]{Msg: &request})
+		}
 		if err != nil {
 			goto end
 		}
-		err = Send(w, response.Msg)
+		err = send(w, response.Msg, codec)
+		sent = err == nil
 	end:
-		WriteTrailer(w, err)
+		finishResponse(w, sent, err)
 	}
 }
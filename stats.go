@@ -0,0 +1,326 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// StatsEvent identifies the kind of a Stats report.
+type StatsEvent int
+
+const (
+	// StatsBegin is reported when a call starts.
+	StatsBegin StatsEvent = iota
+	// StatsInPayload is reported when a message is received.
+	StatsInPayload
+	// StatsOutPayload is reported when a message is sent.
+	StatsOutPayload
+	// StatsEnd is reported when a call ends.
+	StatsEnd
+)
+
+// Stats describes an event in the life of a call.
+type Stats struct {
+	Event StatsEvent
+	// Client is true for calls made by clients and false for calls handled by servers.
+	Client bool
+	// Method is the full path of the method, e.g. "/echo.v1.Echo/Get". Servers
+	// report requests that don't reach a handler with the method "unknown".
+	Method    string
+	BeginTime time.Time
+	// RemoteAddr is the address of the client, for calls handled by servers.
+	RemoteAddr string
+	// Size is the length of a message as it is sent on the wire, for payload events.
+	Size int
+	// EndTime, Code and Err describe the result of a call, and the message
+	// counts and sizes are totals for the call, for end events.
+	EndTime          time.Time
+	Code             codes.Code
+	Err              error
+	MessagesReceived int
+	MessagesSent     int
+	BytesReceived    int64
+	BytesSent        int64
+}
+
+// unknownMethod is the method of requests that don't reach a handler.
+const unknownMethod = "unknown"
+
+// callTotals counts the messages of a call, which may be sent
+// and received on different goroutines.
+type callTotals struct {
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+	bytesReceived    atomic.Int64
+	bytesSent        atomic.Int64
+}
+
+func (t *callTotals) received(size int) *Stats {
+	t.messagesReceived.Add(1)
+	t.bytesReceived.Add(int64(size))
+	return &Stats{Event: StatsInPayload, Size: size}
+}
+
+func (t *callTotals) sent(size int) *Stats {
+	t.messagesSent.Add(1)
+	t.bytesSent.Add(int64(size))
+	return &Stats{Event: StatsOutPayload, Size: size}
+}
+
+func (t *callTotals) end(err error) *Stats {
+	return &Stats{
+		Event:            StatsEnd,
+		EndTime:          time.Now(),
+		Code:             codes.Code(ErrorCode(err)),
+		Err:              err,
+		MessagesReceived: int(t.messagesReceived.Load()),
+		MessagesSent:     int(t.messagesSent.Load()),
+		BytesReceived:    t.bytesReceived.Load(),
+		BytesSent:        t.bytesSent.Load(),
+	}
+}
+
+// StatsHandler observes calls for metrics and tracing integrations.
+//
+// HandleStats is called with the context of each call, and it may be called
+// from several goroutines at once. Clients report each attempt of a call that
+// is retried or hedged as a separate call.
+type StatsHandler interface {
+	HandleStats(ctx context.Context, stats *Stats)
+}
+
+// HandleStats wraps a handler so that the gRPC calls that it serves are reported
+// to a StatsHandler. When it is used with HandleGRPCWeb or HandleConnect, it
+// should wrap the handler that they wrap, so that it sees the translated calls.
+// Requests that are not gRPC requests are passed to the handler without being reported.
+//
+// Calls are reported when they are accepted by a handler of this package, such as
+// HandleUnary. Requests for paths without such handlers, which clients can choose
+// freely, are all reported with the method "unknown" when they end, so that they
+// don't add to the methods that StatsHandlers such as PrometheusStats keep.
+func HandleStats(handler http.Handler, stats StatsHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx := incomingContext(r)
+		begin := time.Now()
+		method := r.URL.Path
+		report := func(s *Stats) {
+			s.Method = method
+			s.BeginTime = begin
+			s.RemoteAddr = r.RemoteAddr
+			stats.HandleStats(ctx, s)
+		}
+		var totals callTotals
+		accepted := false
+		r = r.WithContext(onAccept(ctx, func(w http.ResponseWriter, r *http.Request) bool {
+			accepted = true
+			report(&Stats{Event: StatsBegin})
+			return true
+		}))
+		r.Body = &readCloser{
+			Reader: &frameCountingReader{r: r.Body, counter: frameCounter{report: func(size int) {
+				report(totals.received(size))
+			}}},
+			Closer: r.Body,
+		}
+		sw := &statsResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		sw.counter.report = func(size int) {
+			report(totals.sent(size))
+		}
+		handler.ServeHTTP(sw, r)
+		if !accepted {
+			method = unknownMethod
+			report(&Stats{Event: StatsBegin})
+		}
+		report(totals.end(sw.err()))
+	})
+}
+
+// statsResponseWriter counts the messages written by a handler and records its status.
+type statsResponseWriter struct {
+	http.ResponseWriter
+	counter frameCounter
+	status  int
+}
+
+func (w *statsResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statsResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.counter.count(b[:n])
+	return n, err
+}
+
+func (w *statsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// err returns the error described by the status that the handler has written.
+func (w *statsResponseWriter) err() error {
+	header := w.Header()
+	status, message := header.Get(http.TrailerPrefix+"Grpc-Status"), header.Get(http.TrailerPrefix+"Grpc-Message")
+	if status == "" {
+		status, message = header.Get("Grpc-Status"), header.Get("Grpc-Message")
+	}
+	if status == "" && w.status != http.StatusOK {
+		// The request did not reach a gRPC handler.
+		return NewError(errors.New("HTTP status "+http.StatusText(w.status)), codes.CodeForHTTPStatus(w.status))
+	}
+	return ErrorForTrailer(http.Header{"Grpc-Status": {status}, "Grpc-Message": {message}})
+}
+
+// statsTransport reports the calls made by a client to a StatsHandler.
+type statsTransport struct {
+	base  http.RoundTripper
+	stats StatsHandler
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	begin := time.Now()
+	report := func(s *Stats) {
+		s.Client = true
+		s.Method = req.URL.Path
+		s.BeginTime = begin
+		t.stats.HandleStats(ctx, s)
+	}
+	var totals callTotals
+	end := func(err error) {
+		report(totals.end(err))
+	}
+	report(&Stats{Event: StatsBegin})
+	if req.Body != nil {
+		req = req.Clone(ctx)
+		req.Body = &readCloser{
+			Reader: &frameCountingReader{r: req.Body, counter: frameCounter{report: func(size int) {
+				report(totals.sent(size))
+			}}},
+			Closer: req.Body,
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		end(transportError(ctx, err))
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.Header.Get("Grpc-Status") == "" {
+		// The body is not a gRPC response, so its messages are not counted.
+		end(NewError(errors.New("unexpected HTTP status "+resp.Status), codes.CodeForHTTPStatus(resp.StatusCode)))
+		return resp, nil
+	}
+	body := &statsResponseBody{
+		ReadCloser: resp.Body,
+		counter: frameCounter{report: func(size int) {
+			report(totals.received(size))
+		}},
+		end: func(eof bool) {
+			if eof {
+				end(ErrorForResponse(resp))
+			} else if err := ErrorForTrailer(resp.Header); err != nil {
+				end(err)
+			} else {
+				// The client stopped reading before the end of the response.
+				end(NewError(errors.New("response not read"), codes.Canceled))
+			}
+		},
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// statsResponseBody counts the messages in a response and reports the end
+// of the call when the body has been read or closed.
+type statsResponseBody struct {
+	io.ReadCloser
+	counter frameCounter
+	once    sync.Once
+	end     func(eof bool)
+}
+
+func (b *statsResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.count(p[:n])
+	if err == io.EOF {
+		b.once.Do(func() { b.end(true) })
+	} else if err != nil {
+		b.once.Do(func() { b.end(false) })
+	}
+	return n, err
+}
+
+func (b *statsResponseBody) Close() error {
+	b.once.Do(func() { b.end(false) })
+	return b.ReadCloser.Close()
+}
+
+// frameCountingReader counts the messages in the gRPC frames that are read from r.
+type frameCountingReader struct {
+	r       io.Reader
+	counter frameCounter
+}
+
+func (r *frameCountingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.counter.count(p[:n])
+	return n, err
+}
+
+// frameCounter reports the size of each message in a stream of gRPC frames.
+type frameCounter struct {
+	prefix    [5]byte
+	prefixLen int
+	remaining int
+	report    func(size int)
+}
+
+func (c *frameCounter) count(b []byte) {
+	for {
+		if c.prefixLen < len(c.prefix) {
+			if len(b) == 0 {
+				return
+			}
+			n := copy(c.prefix[c.prefixLen:], b)
+			c.prefixLen += n
+			b = b[n:]
+			if c.prefixLen < len(c.prefix) {
+				return
+			}
+			c.remaining = int(binary.BigEndian.Uint32(c.prefix[1:5]))
+		}
+		n := min(len(b), c.remaining)
+		c.remaining -= n
+		b = b[n:]
+		if c.remaining > 0 {
+			return
+		}
+		c.report(int(binary.BigEndian.Uint32(c.prefix[1:5])))
+		c.prefixLen = 0
+	}
+}
+
+// splitMethod returns the service and method names of a full method path.
+func splitMethod(method string) (string, string) {
+	service, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	return service, name
+}
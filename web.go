@@ -0,0 +1,316 @@
+package sidecar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Protocol selects the wire protocol used by a client.
+type Protocol string
+
+const (
+	// ProtocolGRPC is standard gRPC over HTTP/2. It is the default.
+	ProtocolGRPC Protocol = "grpc"
+	// ProtocolGRPCWeb is gRPC-Web with binary messages.
+	ProtocolGRPCWeb Protocol = "grpc-web"
+	// ProtocolGRPCWebText is gRPC-Web with base64-encoded messages.
+	ProtocolGRPCWebText Protocol = "grpc-web-text"
+)
+
+func (p Protocol) isWeb() bool {
+	return p == ProtocolGRPCWeb || p == ProtocolGRPCWebText
+}
+
+const (
+	grpcContentType    = "application/grpc"
+	grpcWebContentType = "application/grpc-web"
+	grpcWebTextType    = "application/grpc-web-text"
+
+	// trailerFlag marks a gRPC-Web frame that contains trailers.
+	trailerFlag = 0x80
+)
+
+// HandleGRPCWeb wraps a handler so that it also serves gRPC-Web requests.
+//
+// Requests with application/grpc-web or application/grpc-web-text content types
+// are translated into gRPC requests for the wrapped handler, and its gRPC responses
+// are translated back, with trailers sent in a final trailer frame. Other responses,
+// such as HTTP errors, are sent unchanged.
+// All other requests are passed to the handler unchanged.
+//
+// Browsers use HTTP/1.1 for gRPC-Web, so servers created with NewServer
+// should also call server.Protocols.SetHTTP1(true).
+func HandleGRPCWeb(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if !strings.HasPrefix(contentType, grpcWebContentType) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		text := strings.HasPrefix(contentType, grpcWebTextType)
+		r = withTranslated(r.Clone(r.Context()))
+		if text {
+			r.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, grpcWebTextType))
+			r.Body = &readCloser{Reader: &base64Reader{r: r.Body}, Closer: r.Body}
+		} else {
+			r.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, grpcWebContentType))
+		}
+		if r.ProtoMajor == 1 {
+			// Allow streaming handlers to read requests after writing responses.
+			_ = http.NewResponseController(w).EnableFullDuplex()
+		}
+		ww := &webResponseWriter{ResponseWriter: w, text: text}
+		handler.ServeHTTP(ww, r)
+		ww.finish()
+	})
+}
+
+// webResponseWriter translates gRPC responses into gRPC-Web responses.
+type webResponseWriter struct {
+	http.ResponseWriter
+	text        bool
+	wroteHeader bool
+	// grpc is set when the handler's response is a gRPC response,
+	// which is translated; other responses are passed through unchanged.
+	grpc bool
+}
+
+func (w *webResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		contentType := header.Get("Content-Type")
+		rest, ok := strings.CutPrefix(contentType, grpcContentType)
+		w.grpc = ok
+		if !ok {
+			w.ResponseWriter.WriteHeader(code)
+			return
+		}
+		if w.text {
+			header.Set("Content-Type", grpcWebTextType+rest)
+		} else {
+			header.Set("Content-Type", grpcWebContentType+rest)
+		}
+		header.Del("Trailer")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *webResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.grpc && w.text {
+		// Each write is separately encoded; readers decode in 4-byte groups.
+		_, err := io.WriteString(w.ResponseWriter, base64.StdEncoding.EncodeToString(b))
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *webResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *webResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish moves any trailers set by the handler into a trailer frame.
+// Responses that aren't gRPC responses, such as HTTP errors, have no trailer frame.
+func (w *webResponseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.grpc {
+		return
+	}
+	trailer := takeTrailers(w.Header())
+	var buf bytes.Buffer
+	for _, key := range slices.Sorted(maps.Keys(trailer)) {
+		for _, value := range trailer[key] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", strings.ToLower(key), value)
+		}
+	}
+	f := frame(buf.Bytes())
+	f.Bytes()[0] = trailerFlag
+	_, _ = w.Write(f.Bytes())
+	w.Flush()
+}
+
+// takeTrailers removes the trailers that a handler has set
+// with http.TrailerPrefix from a header and returns them.
+func takeTrailers(header http.Header) http.Header {
+	trailer := make(http.Header)
+	for key, values := range header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			trailer[http.CanonicalHeaderKey(name)] = values
+			delete(header, key)
+		}
+	}
+	return trailer
+}
+
+// webTransport translates gRPC requests into gRPC-Web requests.
+type webTransport struct {
+	base http.RoundTripper
+	text bool
+}
+
+func (t *webTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	contentType := req.Header.Get("Content-Type")
+	if rest, ok := strings.CutPrefix(contentType, grpcContentType); ok {
+		if t.text {
+			req.Header.Set("Content-Type", grpcWebTextType+rest)
+		} else {
+			req.Header.Set("Content-Type", grpcWebContentType+rest)
+		}
+	}
+	req.Header.Del("Te")
+	if t.text && req.Body != nil {
+		req.Body = &readCloser{Reader: &base64Encoder{r: req.Body}, Closer: req.Body}
+		req.ContentLength = -1
+		req.GetBody = nil
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	contentType = resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, grpcWebContentType) {
+		return resp, nil
+	}
+	var body io.Reader = resp.Body
+	if strings.HasPrefix(contentType, grpcWebTextType) {
+		body = &base64Reader{r: resp.Body}
+		resp.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, grpcWebTextType))
+	} else {
+		resp.Header.Set("Content-Type", grpcContentType+strings.TrimPrefix(contentType, grpcWebContentType))
+	}
+	resp.Body = &readCloser{Reader: &webResponseReader{r: body, resp: resp}, Closer: resp.Body}
+	return resp, nil
+}
+
+// webResponseReader passes message frames through and
+// moves the contents of the trailer frame into the response trailer.
+type webResponseReader struct {
+	r       io.Reader
+	resp    *http.Response
+	pending []byte
+	err     error
+}
+
+func (r *webResponseReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *webResponseReader) next() error {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r.r, prefix); err != nil {
+		return err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(prefix[1:5]))
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if prefix[0]&trailerFlag == 0 {
+		r.pending = append(prefix, b...)
+		return nil
+	}
+	if r.resp.Trailer == nil {
+		r.resp.Trailer = make(http.Header)
+	}
+	for line := range strings.SplitSeq(string(b), "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			r.resp.Trailer.Add(http.CanonicalHeaderKey(strings.TrimSpace(key)), strings.TrimSpace(value))
+		}
+	}
+	return io.EOF
+}
+
+// base64Reader decodes base64 text that may be a concatenation of
+// separately-padded chunks by decoding it in 4-byte groups.
+type base64Reader struct {
+	r       io.Reader
+	encoded []byte
+	decoded []byte
+	err     error
+}
+
+func (r *base64Reader) Read(p []byte) (int, error) {
+	for len(r.decoded) == 0 {
+		if r.err != nil {
+			if r.err == io.EOF && len(r.encoded) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, r.err
+		}
+		buf := make([]byte, 4096)
+		n, err := r.r.Read(buf)
+		r.encoded = append(r.encoded, buf[:n]...)
+		r.err = err
+		group := make([]byte, 3)
+		for len(r.encoded) >= 4 {
+			m, err := base64.StdEncoding.Decode(group, r.encoded[:4])
+			if err != nil {
+				r.err = err
+				break
+			}
+			r.decoded = append(r.decoded, group[:m]...)
+			r.encoded = r.encoded[4:]
+		}
+	}
+	n := copy(p, r.decoded)
+	r.decoded = r.decoded[n:]
+	return n, nil
+}
+
+// base64Encoder encodes everything read from r as base64.
+type base64Encoder struct {
+	r       io.Reader
+	encoded []byte
+}
+
+func (e *base64Encoder) Read(p []byte) (int, error) {
+	if len(e.encoded) == 0 {
+		buf := make([]byte, 3*1024)
+		n, err := e.r.Read(buf)
+		if n == 0 {
+			return 0, err
+		}
+		e.encoded = []byte(base64.StdEncoding.EncodeToString(buf[:n]))
+	}
+	n := copy(p, e.encoded)
+	e.encoded = e.encoded[n:]
+	return n, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
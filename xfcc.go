@@ -0,0 +1,168 @@
+package sidecar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/agentio/sidecar/codes"
+)
+
+// ForwardedClientCert describes a client certificate that a proxy, such as an
+// Envoy or Istio sidecar, has verified and reported in an x-forwarded-client-cert
+// (XFCC) header. See https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_conn_man/headers#x-forwarded-client-cert.
+type ForwardedClientCert struct {
+	// By is the URI SAN of the certificate of the proxy that verified the client certificate.
+	By string
+	// Hash is the SHA-256 digest of the client certificate.
+	Hash string
+	// Cert and Chain are the PEM-encoded client certificate and its chain.
+	Cert  string
+	Chain string
+	// Subject is the subject of the client certificate.
+	Subject string
+	// URI and DNS are the URI and DNS SANs of the client certificate.
+	URI []string
+	DNS []string
+}
+
+// SPIFFEID returns the SPIFFE ID of a forwarded certificate, which is its URI SAN with
+// the spiffe scheme, or an empty string if it has none.
+func (c *ForwardedClientCert) SPIFFEID() string {
+	for _, uri := range c.URI {
+		if strings.HasPrefix(uri, "spiffe://") {
+			return uri
+		}
+	}
+	return ""
+}
+
+// ParseForwardedClientCert parses the value of an x-forwarded-client-cert header,
+// which describes a certificate for each proxy hop that forwarded the request.
+// The last element is added by the nearest proxy.
+func ParseForwardedClientCert(value string) ([]*ForwardedClientCert, error) {
+	var certs []*ForwardedClientCert
+	for _, element := range splitQuoted(value, ',') {
+		cert := &ForwardedClientCert{}
+		for _, pair := range splitQuoted(element, ';') {
+			key, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid x-forwarded-client-cert pair %q", pair)
+			}
+			v, err := unquoteXFCC(v)
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "by":
+				cert.By = v
+			case "hash":
+				cert.Hash = v
+			case "cert":
+				cert.Cert, err = url.PathUnescape(v)
+			case "chain":
+				cert.Chain, err = url.PathUnescape(v)
+			case "subject":
+				cert.Subject = v
+			case "uri":
+				cert.URI = append(cert.URI, v)
+			case "dns":
+				cert.DNS = append(cert.DNS, v)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid x-forwarded-client-cert %s: %w", key, err)
+			}
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// splitQuoted splits a string at separators that are not in double-quoted values.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// unquoteXFCC removes the quotes and escapes of a double-quoted value.
+func unquoteXFCC(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, `"`) {
+		return v, nil
+	}
+	if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+		return "", fmt.Errorf("invalid x-forwarded-client-cert value %s", v)
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' {
+			// A backslash before the last quote escapes it, so the value is unterminated.
+			if i+1 == len(v)-1 {
+				return "", fmt.Errorf("invalid x-forwarded-client-cert value %s", v)
+			}
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String(), nil
+}
+
+// forwardedClientCertKey holds the client certificate reported by a trusted proxy.
+type forwardedClientCertKey struct{}
+
+// HandleForwardedClientCert wraps a handler so that the client certificates that
+// trusted proxies report in x-forwarded-client-cert headers are available to handlers
+// in the ForwardedCert and SPIFFEID fields of their peers. The trusted function is
+// called with the peer of each request that has the header; the headers of requests
+// from untrusted peers are removed, and requests from trusted peers with invalid
+// headers are rejected with Unauthenticated errors.
+//
+// For example, a sidecar proxy that connects to a service over the loopback
+// interface can be trusted with a function that checks the peer's Addr.
+func HandleForwardedClientCert(handler http.Handler, trusted func(p *Peer) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Proxies may add their elements in separate header lines.
+		value := strings.Join(r.Header.Values("X-Forwarded-Client-Cert"), ",")
+		if value == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		p, _ := PeerFromContext(withPeer(r.Context(), r))
+		if !trusted(p) {
+			r = r.Clone(r.Context())
+			r.Header.Del("X-Forwarded-Client-Cert")
+			handler.ServeHTTP(w, r)
+			return
+		}
+		certs, err := ParseForwardedClientCert(value)
+		if err == nil && len(certs) == 0 {
+			err = errors.New("x-forwarded-client-cert header is empty")
+		}
+		if err != nil {
+			writeTrailersOnly(w, NewError(err, codes.Unauthenticated))
+			return
+		}
+		ctx := r.Context()
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(ctx, forwardedClientCertKey{}, certs[len(certs)-1])))
+	})
+}
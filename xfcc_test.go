@@ -0,0 +1,58 @@
+package sidecar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardedClientCert(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected []*ForwardedClientCert
+		err      string
+	}{
+		{
+			value:    "By=spiffe://td/proxy;URI=spiffe://td/caller",
+			expected: []*ForwardedClientCert{{By: "spiffe://td/proxy", URI: []string{"spiffe://td/caller"}}},
+		},
+		{
+			value: `URI=spiffe://td/web, by=spiffe://td/proxy ; Hash=abc;dns=a;DNS=b`,
+			expected: []*ForwardedClientCert{
+				{URI: []string{"spiffe://td/web"}},
+				{By: "spiffe://td/proxy", Hash: "abc", DNS: []string{"a", "b"}},
+			},
+		},
+		{
+			value:    `Subject="CN=Test, O=\"Acme; Inc\"";Cert="-----BEGIN%20CERTIFICATE-----%0A";Chain="a%2Cb"`,
+			expected: []*ForwardedClientCert{{Subject: `CN=Test, O="Acme; Inc"`, Cert: "-----BEGIN CERTIFICATE-----\n", Chain: "a,b"}},
+		},
+		{
+			value:    "Hash=abc;Unknown=ignored",
+			expected: []*ForwardedClientCert{{Hash: "abc"}},
+		},
+		{value: "Hash", err: `invalid x-forwarded-client-cert pair "Hash"`},
+		{value: "By=spiffe://td/proxy;;Hash=abc", err: `invalid x-forwarded-client-cert pair ""`},
+		{value: `Subject="unterminated`, err: "invalid x-forwarded-client-cert value"},
+		{value: `Subject="unterminated;URI=spiffe://td/caller`, err: "invalid x-forwarded-client-cert value"},
+		{value: `Subject="`, err: "invalid x-forwarded-client-cert value"},
+		{value: `Subject="escaped end\"`, err: "invalid x-forwarded-client-cert value"},
+		{value: `Cert="%zz"`, err: "invalid x-forwarded-client-cert Cert"},
+		{value: `Chain=%`, err: "invalid x-forwarded-client-cert Chain"},
+	} {
+		certs, err := ParseForwardedClientCert(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error containing %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(certs, test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.value, test.expected, certs)
+		}
+	}
+}